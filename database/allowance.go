@@ -0,0 +1,420 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+func DefaultAllowanceRules() []handler.AllowanceRule {
+	rules := []handler.AllowanceRule{
+		{AllowanceType: "donation", CapType: handler.CapGroup, Group: "donation"},
+		{AllowanceType: "k-receipt", CapType: handler.CapFixed, Amount: handler.Baht(50000)},
+	}
+	rules = append(rules, DefaultInsuranceRules()...)
+	rules = append(rules, DefaultRetirementRules()...)
+	return append(rules, DefaultDonationRules()...)
+}
+
+// DefaultDonationRules are the donation subtypes. Education, sports and
+// hospital donations count double and, with general donations, share the
+// donation group of 10% of net income. Political party donations have their
+// own cap.
+func DefaultDonationRules() []handler.AllowanceRule {
+	return []handler.AllowanceRule{
+		{AllowanceType: "donation", Subtype: "education", CapType: handler.CapGroup, Multiplier: 2, Group: "donation"},
+		{AllowanceType: "donation", Subtype: "sports", CapType: handler.CapGroup, Multiplier: 2, Group: "donation"},
+		{AllowanceType: "donation", Subtype: "hospital", CapType: handler.CapGroup, Multiplier: 2, Group: "donation"},
+		{AllowanceType: "donation", Subtype: "political", CapType: handler.CapFixed, Amount: handler.Baht(10000)},
+	}
+}
+
+// DefaultInsuranceRules are the insurance, social security and home-loan
+// allowances. Life and health insurance share the insurance group; social
+// security is capped at the statutory contribution of 5% of wages, at most
+// 750 a month.
+func DefaultInsuranceRules() []handler.AllowanceRule {
+	return []handler.AllowanceRule{
+		{AllowanceType: "life-insurance", CapType: handler.CapFixed, Amount: handler.Baht(100000), Group: "insurance"},
+		{AllowanceType: "health-insurance", CapType: handler.CapFixed, Amount: handler.Baht(25000), Group: "insurance"},
+		{AllowanceType: "parent-health-insurance", CapType: handler.CapFixed, Amount: handler.Baht(15000)},
+		{AllowanceType: "social-security", CapType: handler.CapIncomePercent, Rate: 0.05, Amount: handler.Baht(9000)},
+		{AllowanceType: "home-loan-interest", CapType: handler.CapFixed, Amount: handler.Baht(100000)},
+	}
+}
+
+// DefaultRetirementRules are the retirement savings allowances. Each has its
+// own cap and all but thai-esg share the retirement group, which they fill
+// in this order.
+func DefaultRetirementRules() []handler.AllowanceRule {
+	return []handler.AllowanceRule{
+		{AllowanceType: "pvd", CapType: handler.CapIncomePercent, Rate: 0.15, Amount: handler.Baht(500000), Group: "retirement"},
+		{AllowanceType: "gpf", CapType: handler.CapIncomePercent, Rate: 0.30, Amount: handler.Baht(500000), Group: "retirement"},
+		{AllowanceType: "pension-insurance", CapType: handler.CapIncomePercent, Rate: 0.15, Amount: handler.Baht(200000), Group: "retirement"},
+		{AllowanceType: "rmf", CapType: handler.CapIncomePercent, Rate: 0.30, Amount: handler.Baht(500000), Group: "retirement"},
+		{AllowanceType: "ssf", CapType: handler.CapIncomePercent, Rate: 0.30, Amount: handler.Baht(200000), Group: "retirement"},
+		{AllowanceType: "thai-esg", CapType: handler.CapIncomePercent, Rate: 0.30, Amount: handler.Baht(300000)},
+	}
+}
+
+func DefaultAllowanceGroups() []handler.AllowanceGroup {
+	return []handler.AllowanceGroup{
+		{Name: "donation", Rate: 0.10},
+		{Name: "insurance", Amount: handler.Baht(100000)},
+		{Name: "retirement", Amount: handler.Baht(500000)},
+	}
+}
+
+func initAllowanceRules(db *sql.DB) error {
+	createTb := `CREATE TABLE IF NOT EXISTS allowance_seeds ( name TEXT PRIMARY KEY);`
+	if _, err := db.Exec(createTb); err != nil {
+		return err
+	}
+	createTb = `CREATE TABLE IF NOT EXISTS allowance_rules ( id SERIAL PRIMARY KEY, tax_year INT NOT NULL, allowance_type TEXT NOT NULL, cap_type TEXT NOT NULL,
+		amount NUMERIC(15,2) NOT NULL DEFAULT 0, rate FLOAT NOT NULL DEFAULT 0, cap_group TEXT NOT NULL DEFAULT '');`
+	if _, err := db.Exec(createTb); err != nil {
+		return err
+	}
+	// Rules used to be unique per allowance type; subtypes make the key
+	// (tax_year, allowance_type, subtype).
+	subtypes := `ALTER TABLE allowance_rules ADD COLUMN IF NOT EXISTS subtype TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS multiplier FLOAT NOT NULL DEFAULT 1;
+		ALTER TABLE allowance_rules DROP CONSTRAINT IF EXISTS allowance_rules_tax_year_allowance_type_key;
+		CREATE UNIQUE INDEX IF NOT EXISTS allowance_rules_key ON allowance_rules (tax_year, allowance_type, subtype);`
+	if _, err := db.Exec(subtypes); err != nil {
+		return err
+	}
+	createTb = `CREATE TABLE IF NOT EXISTS allowance_groups ( tax_year INT NOT NULL, name TEXT NOT NULL, amount NUMERIC(15,2) NOT NULL, PRIMARY KEY (tax_year, name));`
+	if _, err := db.Exec(createTb); err != nil {
+		return err
+	}
+	if _, err := db.Exec("ALTER TABLE allowance_groups ADD COLUMN IF NOT EXISTS rate FLOAT NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// Caps used to be fixed columns of tax_years; move them into the registry.
+	legacy, err := columnExists(db, "tax_years", "max_k_receipt")
+	if err != nil {
+		return err
+	}
+	if legacy {
+		migrate := `INSERT INTO allowance_rules (tax_year, allowance_type, cap_type, amount)
+			SELECT year, 'k-receipt', $1, max_k_receipt FROM tax_years
+			UNION ALL SELECT year, 'donation', $1, max_donation FROM tax_years
+			ON CONFLICT (tax_year, allowance_type, subtype) DO NOTHING`
+		if _, err := db.Exec(migrate, handler.CapFixed); err != nil {
+			return err
+		}
+		if _, err := db.Exec("ALTER TABLE tax_years DROP COLUMN max_k_receipt, DROP COLUMN IF EXISTS max_donation"); err != nil {
+			return err
+		}
+	}
+	if legacy, err = tableExists(db, "allowance"); err != nil {
+		return err
+	}
+	if legacy {
+		// The single-year allowance table is kept, so carry it over only
+		// once; a k-receipt rule an admin removed later stays removed.
+		migrate := `INSERT INTO allowance_rules (tax_year, allowance_type, cap_type, amount)
+			SELECT $1, 'k-receipt', $2, maxKReceipt FROM allowance WHERE id = 1 ON CONFLICT (tax_year, allowance_type, subtype) DO NOTHING`
+		if err := seed(db, "migrate:legacy-k-receipt", migrate, DefaultTaxYear, handler.CapFixed); err != nil {
+			return err
+		}
+	}
+	return seedAllowanceRules(db)
+}
+
+// seedAllowanceRules adds the default rules and groups of DefaultTaxYear
+// that were never seeded before, so allowance types introduced by later
+// versions reach existing databases while the ones an admin removed stay
+// removed. Values already stored are kept.
+func seedAllowanceRules(db *sql.DB) error {
+	for _, group := range DefaultAllowanceGroups() {
+		insert := `INSERT INTO allowance_groups (tax_year, name, amount, rate) values ($1, $2, $3, $4) ON CONFLICT (tax_year, name) DO NOTHING`
+		if err := seed(db, "group:"+group.Name, insert, DefaultTaxYear, group.Name, group.Amount, group.Rate); err != nil {
+			return err
+		}
+	}
+	for _, rule := range DefaultAllowanceRules() {
+		insert := `INSERT INTO allowance_rules (tax_year, allowance_type, subtype, cap_type, amount, rate, cap_group, multiplier) values ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (tax_year, allowance_type, subtype) DO NOTHING`
+		if err := seed(db, "rule:"+rule.Key(), insert, DefaultTaxYear, rule.AllowanceType, rule.Subtype, rule.CapType, rule.Amount, rule.Rate, rule.Group, rule.Multiplier); err != nil {
+			return err
+		}
+	}
+	// General donations used to be capped at a fixed 100,000. Move the
+	// untouched old default into the donation group of 10% of net income.
+	update := `UPDATE allowance_rules SET cap_type = $1, amount = 0, cap_group = 'donation'
+		WHERE tax_year = $2 AND allowance_type = 'donation' AND subtype = '' AND cap_type = $3 AND amount = 100000`
+	return seed(db, "migrate:donation-net-income", update, handler.CapGroup, DefaultTaxYear, handler.CapFixed)
+}
+
+// seed runs stmt only the first time it is called with name, recording
+// name in allowance_seeds in the same transaction, so a stmt that fails is
+// tried again on the next start.
+func seed(db *sql.DB, name, stmt string, args ...any) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO allowance_seeds (name) values ($1) ON CONFLICT (name) DO NOTHING", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(stmt, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func upsertAllowanceRule(db execer, taxYear int, rule handler.AllowanceRule) error {
+	upsert := `INSERT INTO allowance_rules (tax_year, allowance_type, subtype, cap_type, amount, rate, cap_group, multiplier) values ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (tax_year, allowance_type, subtype) DO UPDATE SET cap_type = $4, amount = $5, rate = $6, cap_group = $7, multiplier = $8`
+	_, err := db.Exec(upsert, taxYear, rule.AllowanceType, rule.Subtype, rule.CapType, rule.Amount, rule.Rate, rule.Group, rule.MultiplierOrOne())
+	return err
+}
+
+func upsertAllowanceGroup(db execer, taxYear int, group handler.AllowanceGroup) error {
+	upsert := `INSERT INTO allowance_groups (tax_year, name, amount, rate) values ($1, $2, $3, $4)
+		ON CONFLICT (tax_year, name) DO UPDATE SET amount = $3, rate = $4`
+	_, err := db.Exec(upsert, taxYear, group.Name, group.Amount, group.Rate)
+	return err
+}
+
+func replaceAllowances(db execer, taxYear int, rules []handler.AllowanceRule, groups []handler.AllowanceGroup) error {
+	if _, err := db.Exec("DELETE FROM allowance_rules WHERE tax_year = $1", taxYear); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM allowance_groups WHERE tax_year = $1", taxYear); err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if err := upsertAllowanceGroup(db, taxYear, group); err != nil {
+			return err
+		}
+	}
+	for _, rule := range rules {
+		if err := upsertAllowanceRule(db, taxYear, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAllowanceRules returns the registry of a tax year in the order the
+// rules were added, which is also the order group caps are filled in.
+func GetAllowanceRules(db *sql.DB, taxYear int) ([]handler.AllowanceRule, error) {
+	rows, err := db.Query("SELECT allowance_type, subtype, cap_type, amount, rate, cap_group, multiplier FROM allowance_rules WHERE tax_year = $1 ORDER BY id", taxYear)
+	if err != nil {
+		return nil, fmt.Errorf("GetAllowanceRules failed: %v", err)
+	}
+	defer rows.Close()
+	var rules []handler.AllowanceRule
+	for rows.Next() {
+		var rule handler.AllowanceRule
+		if err := rows.Scan(&rule.AllowanceType, &rule.Subtype, &rule.CapType, &rule.Amount, &rule.Rate, &rule.Group, &rule.Multiplier); err != nil {
+			return nil, fmt.Errorf("GetAllowanceRules failed: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetAllowanceRules failed: %v", err)
+	}
+	return rules, nil
+}
+
+func GetAllowanceGroups(db *sql.DB, taxYear int) ([]handler.AllowanceGroup, error) {
+	rows, err := db.Query("SELECT name, amount, rate FROM allowance_groups WHERE tax_year = $1 ORDER BY name", taxYear)
+	if err != nil {
+		return nil, fmt.Errorf("GetAllowanceGroups failed: %v", err)
+	}
+	defer rows.Close()
+	var groups []handler.AllowanceGroup
+	for rows.Next() {
+		var group handler.AllowanceGroup
+		if err := rows.Scan(&group.Name, &group.Amount, &group.Rate); err != nil {
+			return nil, fmt.Errorf("GetAllowanceGroups failed: %v", err)
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetAllowanceGroups failed: %v", err)
+	}
+	return groups, nil
+}
+
+func ValidateAllowanceRules(rules []handler.AllowanceRule, groups []handler.AllowanceGroup) error {
+	groupNames := map[string]bool{}
+	for _, group := range groups {
+		if group.Name == "" {
+			return fmt.Errorf("group name is required")
+		}
+		if groupNames[group.Name] {
+			return fmt.Errorf("group %q is defined twice", group.Name)
+		}
+		if group.Amount < 0 {
+			return fmt.Errorf("group %q amount must not be negative", group.Name)
+		}
+		if group.Rate < 0 || group.Rate > 1 {
+			return fmt.Errorf("group %q rate must be between 0 and 1", group.Name)
+		}
+		groupNames[group.Name] = true
+	}
+	types := map[string]bool{}
+	for _, rule := range rules {
+		if rule.AllowanceType == "" {
+			return fmt.Errorf("allowanceType is required")
+		}
+		if types[rule.Key()] {
+			return fmt.Errorf("allowanceType %q is defined twice", rule.Key())
+		}
+		types[rule.Key()] = true
+		if rule.Multiplier < 0 {
+			return fmt.Errorf("%s multiplier must not be negative", rule.Key())
+		}
+		if rule.Amount < 0 {
+			return fmt.Errorf("%s amount must not be negative", rule.AllowanceType)
+		}
+		if rule.Rate < 0 || rule.Rate > 1 {
+			return fmt.Errorf("%s rate must be between 0 and 1", rule.AllowanceType)
+		}
+		switch rule.CapType {
+		case handler.CapFixed:
+		case handler.CapIncomePercent, handler.CapNetIncomePercent:
+			if rule.Rate == 0 {
+				return fmt.Errorf("%s rate is required for capType %s", rule.AllowanceType, rule.CapType)
+			}
+		case handler.CapGroup:
+			if rule.Group == "" {
+				return fmt.Errorf("%s group is required for capType %s", rule.AllowanceType, rule.CapType)
+			}
+		default:
+			return fmt.Errorf("%s has unknown capType %q", rule.AllowanceType, rule.CapType)
+		}
+		if rule.Group != "" && !groupNames[rule.Group] {
+			return fmt.Errorf("%s refers to unknown group %q", rule.AllowanceType, rule.Group)
+		}
+	}
+	return nil
+}
+
+func ListAllowances(c echo.Context) error {
+	taxYear, err := QueryTaxYear(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := checkTaxYear(taxYear); err != nil {
+		return taxYearResponse(c, err)
+	}
+	var response handler.RequestAllowances
+	if response.Allowances, err = GetAllowanceRules(DB, taxYear); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	if response.Groups, err = GetAllowanceGroups(DB, taxYear); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func UpdateAllowanceRule(c echo.Context) error {
+	taxYear, err := QueryTaxYear(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	var request handler.AllowanceRule
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	request.AllowanceType = c.Param("allowanceType")
+	if err := checkTaxYear(taxYear); err != nil {
+		return taxYearResponse(c, err)
+	}
+	rules, err := GetAllowanceRules(DB, taxYear)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	groups, err := GetAllowanceGroups(DB, taxYear)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	replaced := false
+	for i := range rules {
+		if rules[i].Key() == request.Key() {
+			rules[i], replaced = request, true
+		}
+	}
+	if !replaced {
+		rules = append(rules, request)
+	}
+	if err := ValidateAllowanceRules(rules, groups); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := upsertAllowanceRule(DB, taxYear, request); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, request)
+}
+
+// UpdateDeduction sets the cap amount of any allowance type, in the same
+// way UpdatePersonal sets the personal allowance.
+func UpdateDeduction(c echo.Context) error {
+	var request handler.RequestDeduction
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	taxYear := TaxYearOrDefault(request.TaxYear)
+	allowanceType, subtype := c.Param("allowanceType"), c.QueryParam("subtype")
+	if err := checkTaxYear(taxYear); err != nil {
+		return taxYearResponse(c, err)
+	}
+	rules, err := GetAllowanceRules(DB, taxYear)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	groups, err := GetAllowanceGroups(DB, taxYear)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	key := handler.AllowanceRule{AllowanceType: allowanceType, Subtype: subtype}.Key()
+	i := slices.IndexFunc(rules, func(rule handler.AllowanceRule) bool { return rule.Key() == key })
+	if i == -1 {
+		return c.JSON(http.StatusBadRequest, Err{Message: fmt.Sprintf("unsupported allowanceType %q", key)})
+	}
+	rules[i].Amount = request.Amount
+	if err := ValidateAllowanceRules(rules, groups); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := upsertAllowanceRule(DB, taxYear, rules[i]); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]any{"allowanceType": allowanceType, "subtype": subtype, "amount": rules[i].Amount})
+}
+
+func UpdateAllowanceGroup(c echo.Context) error {
+	taxYear, err := QueryTaxYear(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	var request handler.AllowanceGroup
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	request.Name = c.Param("name")
+	if err := ValidateAllowanceRules(nil, []handler.AllowanceGroup{request}); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := checkTaxYear(taxYear); err != nil {
+		return taxYearResponse(c, err)
+	}
+	if err := upsertAllowanceGroup(DB, taxYear, request); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, request)
+}
@@ -0,0 +1,211 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+var (
+	ErrUnknownBatch = errors.New("unknown batch")
+	ErrBatchLost    = errors.New("batch is no longer running")
+)
+
+func initBatches(db *sql.DB) error {
+	createTb := `CREATE TABLE IF NOT EXISTS tax_batches ( id BIGSERIAL PRIMARY KEY, status TEXT NOT NULL, mode TEXT NOT NULL, file BYTEA NOT NULL,
+		total_rows INT NOT NULL DEFAULT 0, processed_rows INT NOT NULL DEFAULT 0, error_rows INT NOT NULL DEFAULT 0, error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(), updated_at TIMESTAMPTZ NOT NULL DEFAULT now());`
+	if _, err := db.Exec(createTb); err != nil {
+		return err
+	}
+	createResults := `CREATE TABLE IF NOT EXISTS tax_batch_results ( id BIGSERIAL PRIMARY KEY, batch_id BIGINT NOT NULL REFERENCES tax_batches (id) ON DELETE CASCADE,
+		line INT NOT NULL, total_income NUMERIC(15,2), tax NUMERIC(15,2), tax_refund NUMERIC(15,2), column_name TEXT, reason TEXT);`
+	if _, err := db.Exec(createResults); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS tax_batch_results_batch ON tax_batch_results (batch_id, id)"); err != nil {
+		return err
+	}
+	_, err := db.Exec("ALTER TABLE tax_batches ADD COLUMN IF NOT EXISTS claim BIGINT NOT NULL DEFAULT 0")
+	return err
+}
+
+// owned returns ErrBatchLost when an update guarded by the claim of batch
+// changed no row, because the batch was requeued or claimed again since.
+func owned(result sql.Result, batch handler.Batch) error {
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %d", ErrBatchLost, batch.ID)
+	}
+	return nil
+}
+
+// BatchStore keeps batch jobs and their results in Postgres.
+type BatchStore struct {
+	DB *sql.DB
+}
+
+func (s BatchStore) Create(mode string, file []byte) (int64, error) {
+	var id int64
+	err := s.DB.QueryRow("INSERT INTO tax_batches (status, mode, file) values ($1, $2, $3) RETURNING id", handler.BatchQueued, mode, file).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("CreateBatch failed: %v", err)
+	}
+	return id, nil
+}
+
+func (s BatchStore) Get(id int64) (handler.Batch, error) {
+	var b handler.Batch
+	err := s.DB.QueryRow(`SELECT id, status, mode, total_rows, processed_rows, error_rows, error, created_at, updated_at, claim FROM tax_batches WHERE id = $1`, id).
+		Scan(&b.ID, &b.Status, &b.Mode, &b.TotalRows, &b.ProcessedRows, &b.ErrorRows, &b.Error, &b.CreatedAt, &b.UpdatedAt, &b.Claim)
+	if errors.Is(err, sql.ErrNoRows) {
+		return b, fmt.Errorf("%w: %d", ErrUnknownBatch, id)
+	}
+	if err != nil {
+		return b, fmt.Errorf("GetBatch failed: %v", err)
+	}
+	return b, nil
+}
+
+func (s BatchStore) File(id int64) ([]byte, error) {
+	var file []byte
+	if err := s.DB.QueryRow("SELECT file FROM tax_batches WHERE id = $1", id).Scan(&file); err != nil {
+		return nil, fmt.Errorf("GetBatchFile failed: %v", err)
+	}
+	return file, nil
+}
+
+// Requeue puts back the running batches not updated for stale, whose
+// worker stopped without releasing them, so they resume after their stored
+// results. A live worker updates its batch with Beat well within stale.
+func (s BatchStore) Requeue(stale time.Duration) error {
+	requeue := "UPDATE tax_batches SET status = $1, updated_at = now() WHERE status = $2 AND updated_at < now() - $3 * interval '1 second'"
+	_, err := s.DB.Exec(requeue, handler.BatchQueued, handler.BatchRunning, stale.Seconds())
+	if err != nil {
+		return fmt.Errorf("RequeueBatches failed: %v", err)
+	}
+	return nil
+}
+
+// Claim marks the oldest queued batch as running under a new claim and
+// returns it. ok is false when no batch is queued. Concurrent claims never
+// get the same batch.
+func (s BatchStore) Claim() (handler.Batch, bool, error) {
+	var id int64
+	claim := `UPDATE tax_batches SET status = $1, claim = claim + 1, updated_at = now() WHERE id = (
+		SELECT id FROM tax_batches WHERE status = $2 ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING id`
+	err := s.DB.QueryRow(claim, handler.BatchRunning, handler.BatchQueued).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return handler.Batch{}, false, nil
+	}
+	if err != nil {
+		return handler.Batch{}, false, fmt.Errorf("ClaimBatch failed: %v", err)
+	}
+	b, err := s.Get(id)
+	return b, err == nil, err
+}
+
+// The updates of a claimed batch below apply only while it is running
+// under the claim of batch, and return ErrBatchLost otherwise.
+const claimed = "id = $1 AND claim = $2 AND status = '" + handler.BatchRunning + "'"
+
+// Beat records that the worker of a running batch is alive.
+func (s BatchStore) Beat(batch handler.Batch) error {
+	result, err := s.DB.Exec("UPDATE tax_batches SET updated_at = now() WHERE "+claimed, batch.ID, batch.Claim)
+	if err != nil {
+		return fmt.Errorf("BeatBatch failed: %v", err)
+	}
+	return owned(result, batch)
+}
+
+// Release puts a running batch back in the queue.
+func (s BatchStore) Release(batch handler.Batch) error {
+	result, err := s.DB.Exec("UPDATE tax_batches SET status = $3, updated_at = now() WHERE "+claimed, batch.ID, batch.Claim, handler.BatchQueued)
+	if err != nil {
+		return fmt.Errorf("ReleaseBatch failed: %v", err)
+	}
+	return owned(result, batch)
+}
+
+func (s BatchStore) Start(batch handler.Batch, totalRows int) error {
+	result, err := s.DB.Exec("UPDATE tax_batches SET total_rows = $3, updated_at = now() WHERE "+claimed, batch.ID, batch.Claim, totalRows)
+	if err != nil {
+		return fmt.Errorf("StartBatch failed: %v", err)
+	}
+	return owned(result, batch)
+}
+
+// Save stores results and the new count of processed rows in one
+// transaction, so a batch resumed later never repeats or skips a row.
+func (s BatchStore) Save(batch handler.Batch, lines []handler.CSVLine, processedRows int) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("SaveBatchResults failed: %v", err)
+	}
+	defer tx.Rollback()
+	insert := "INSERT INTO tax_batch_results (batch_id, line, total_income, tax, tax_refund, column_name, reason) values ($1, $2, $3, $4, $5, $6, $7)"
+	errorRows := map[int]bool{}
+	for _, l := range lines {
+		if l.Error != nil {
+			errorRows[l.Error.Line] = true
+			_, err = tx.Exec(insert, batch.ID, l.Error.Line, nil, nil, nil, l.Error.Column, l.Error.Reason)
+		} else {
+			_, err = tx.Exec(insert, batch.ID, l.Tax.Line, l.Tax.TotalIncome, l.Tax.Tax, l.Tax.TaxRefund, nil, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("SaveBatchResults failed: %v", err)
+		}
+	}
+	update := "UPDATE tax_batches SET processed_rows = $3, error_rows = error_rows + $4, updated_at = now() WHERE " + claimed
+	result, err := tx.Exec(update, batch.ID, batch.Claim, processedRows, len(errorRows))
+	if err != nil {
+		return fmt.Errorf("SaveBatchResults failed: %v", err)
+	}
+	if err := owned(result, batch); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("SaveBatchResults failed: %v", err)
+	}
+	return nil
+}
+
+func (s BatchStore) Finish(batch handler.Batch, status, message string) error {
+	result, err := s.DB.Exec("UPDATE tax_batches SET status = $3, error = $4, updated_at = now() WHERE "+claimed, batch.ID, batch.Claim, status, message)
+	if err != nil {
+		return fmt.Errorf("FinishBatch failed: %v", err)
+	}
+	return owned(result, batch)
+}
+
+// Results returns up to limit results stored after the cursor after, in
+// file order, and the cursor of the last one.
+func (s BatchStore) Results(id, after int64, limit int) ([]handler.CSVLine, int64, error) {
+	rows, err := s.DB.Query(`SELECT id, line, total_income, tax, tax_refund, column_name, reason FROM tax_batch_results
+		WHERE batch_id = $1 AND id > $2 ORDER BY id LIMIT $3`, id, after, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("GetBatchResults failed: %v", err)
+	}
+	defer rows.Close()
+	lines := []handler.CSVLine{}
+	cursor := after
+	for rows.Next() {
+		var line int
+		var totalIncome, tax, taxRefund sql.Null[handler.Money]
+		var column, reason sql.Null[string]
+		if err := rows.Scan(&cursor, &line, &totalIncome, &tax, &taxRefund, &column, &reason); err != nil {
+			return nil, 0, fmt.Errorf("GetBatchResults failed: %v", err)
+		}
+		if reason.Valid {
+			lines = append(lines, handler.CSVLine{Error: &handler.CSVError{Line: line, Column: column.V, Reason: reason.V}})
+		} else {
+			lines = append(lines, handler.CSVLine{Tax: &handler.ResponseCSV{Line: line, TotalIncome: totalIncome.V, Tax: tax.V, TaxRefund: taxRefund.V}})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("GetBatchResults failed: %v", err)
+	}
+	return lines, cursor, nil
+}
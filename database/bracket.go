@@ -0,0 +1,189 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+func DefaultBrackets() []handler.Bracket {
+	upTo := func(amount int64) *handler.Money { m := handler.Baht(amount); return &m }
+	return []handler.Bracket{
+		{MinAmount: handler.Baht(0), MaxAmount: upTo(150000), Rate: 0.00},
+		{MinAmount: handler.Baht(150000), MaxAmount: upTo(500000), Rate: 0.10},
+		{MinAmount: handler.Baht(500000), MaxAmount: upTo(1000000), Rate: 0.15},
+		{MinAmount: handler.Baht(1000000), MaxAmount: upTo(2000000), Rate: 0.20},
+		{MinAmount: handler.Baht(2000000), MaxAmount: nil, Rate: 0.35},
+	}
+}
+
+func initBrackets(db *sql.DB) error {
+	createTb := `CREATE TABLE IF NOT EXISTS tax_brackets ( id SERIAL PRIMARY KEY, min_amount NUMERIC(15,2) NOT NULL, max_amount NUMERIC(15,2), rate FLOAT NOT NULL);`
+	if _, err := db.Exec(createTb); err != nil {
+		return err
+	}
+	if err := numericColumns(db, "tax_brackets", "min_amount", "max_amount"); err != nil {
+		return err
+	}
+	addYear := fmt.Sprintf(`ALTER TABLE tax_brackets ADD COLUMN IF NOT EXISTS tax_year INT NOT NULL DEFAULT %d;`, DefaultTaxYear)
+	if _, err := db.Exec(addYear); err != nil {
+		return err
+	}
+	// Brackets used to be stored as closed whole-baht ranges, e.g. 150,001 -
+	// 500,000. Move each lower bound back onto the previous upper bound.
+	halfOpen := `UPDATE tax_brackets b SET min_amount = p.max_amount FROM tax_brackets p
+		WHERE p.tax_year = b.tax_year AND b.min_amount = p.max_amount + 1`
+	if _, err := db.Exec(halfOpen); err != nil {
+		return err
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM tax_brackets WHERE tax_year = $1", DefaultTaxYear).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	return insertBrackets(db, DefaultTaxYear, DefaultBrackets())
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertBrackets(db execer, taxYear int, brackets []handler.Bracket) error {
+	for _, b := range brackets {
+		if _, err := db.Exec("INSERT INTO tax_brackets (tax_year, min_amount, max_amount, rate) values ($1, $2, $3, $4)", taxYear, b.MinAmount, b.MaxAmount, b.Rate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetBrackets(db *sql.DB, taxYear int) ([]handler.Bracket, error) {
+	rows, err := db.Query("SELECT min_amount, max_amount, rate FROM tax_brackets WHERE tax_year = $1 ORDER BY min_amount", taxYear)
+	if err != nil {
+		return nil, fmt.Errorf("GetBrackets failed: %v", err)
+	}
+	defer rows.Close()
+	var brackets []handler.Bracket
+	for rows.Next() {
+		var b handler.Bracket
+		var maxAmount sql.Null[handler.Money]
+		if err := rows.Scan(&b.MinAmount, &maxAmount, &b.Rate); err != nil {
+			return nil, fmt.Errorf("GetBrackets failed: %v", err)
+		}
+		if maxAmount.Valid {
+			b.MaxAmount = &maxAmount.V
+		}
+		brackets = append(brackets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetBrackets failed: %v", err)
+	}
+	if len(brackets) == 0 {
+		return nil, fmt.Errorf("GetBrackets failed: %w", taxYearError(sql.ErrNoRows, taxYear))
+	}
+	if err := ValidateBrackets(brackets); err != nil {
+		return nil, fmt.Errorf("GetBrackets failed: %v", err)
+	}
+	return brackets, nil
+}
+
+// ValidateBrackets checks that a bracket set starts at zero, that every
+// bracket begins exactly where the previous one ends, that only the last
+// bracket is open-ended and that rates never decrease. A bracket covers the
+// amounts above MinAmount up to and including MaxAmount.
+func ValidateBrackets(brackets []handler.Bracket) error {
+	if len(brackets) == 0 {
+		return fmt.Errorf("at least one bracket is required")
+	}
+	if brackets[0].MinAmount != 0 {
+		return fmt.Errorf("bracket 1 must start at 0")
+	}
+	for i, b := range brackets {
+		if b.Rate < 0 || b.Rate > 1 {
+			return fmt.Errorf("bracket %d rate must be between 0 and 1", i+1)
+		}
+		if i > 0 && b.Rate < brackets[i-1].Rate {
+			return fmt.Errorf("bracket %d rate must not be lower than bracket %d", i+1, i)
+		}
+		if b.MaxAmount == nil {
+			if i != len(brackets)-1 {
+				return fmt.Errorf("only the last bracket may have no maxAmount")
+			}
+			continue
+		}
+		if *b.MaxAmount <= b.MinAmount {
+			return fmt.Errorf("bracket %d maxAmount must be greater than minAmount", i+1)
+		}
+		if i == len(brackets)-1 {
+			return fmt.Errorf("last bracket must have no maxAmount")
+		}
+		if next := brackets[i+1].MinAmount; next != *b.MaxAmount {
+			return fmt.Errorf("bracket %d must start at %v", i+2, *b.MaxAmount)
+		}
+	}
+	return nil
+}
+
+func ListBrackets(c echo.Context) error {
+	taxYear, err := QueryTaxYear(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	brackets, err := GetBrackets(DB, taxYear)
+	if errors.Is(err, ErrUnknownTaxYear) {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, handler.RequestBrackets{Brackets: brackets})
+}
+
+func CheckBrackets(c echo.Context) error {
+	var request handler.RequestBrackets
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := ValidateBrackets(request.Brackets); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, request)
+}
+
+func ReplaceBrackets(c echo.Context) error {
+	taxYear, err := QueryTaxYear(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	var request handler.RequestBrackets
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := ValidateBrackets(request.Brackets); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := checkTaxYear(taxYear); err != nil {
+		return taxYearResponse(c, err)
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM tax_brackets WHERE tax_year = $1", taxYear); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	if err := insertBrackets(tx, taxYear, request.Brackets); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, request)
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,13 +14,23 @@ import (
 	_ "github.com/lib/pq"
 )
 
+// ErrNoKReceiptRule is returned for a tax year that exists but whose
+// k-receipt rule an admin removed.
+var ErrNoKReceiptRule = errors.New("no k-receipt rule for tax year")
+
 type Err struct {
 	Message string `json:"message"`
 }
 
 type DataStruct struct {
-	PersonalAllowance float64
-	MaxKReceipt       float64
+	TaxYear           int
+	PersonalAllowance handler.Money
+	Allowances        []handler.AllowanceRule
+	Groups            []handler.AllowanceGroup
+	Expenses          []handler.ExpenseRule
+	MinimumTax        handler.MinimumTax
+	Dependents        handler.DependentRules
+	Brackets          []handler.Bracket
 }
 
 var DB *sql.DB
@@ -33,88 +44,131 @@ func Init() {
 	if err = DB.Ping(); err != nil {
 		log.Fatal("Ping database failed", err)
 	}
-	createTb := `CREATE TABLE IF NOT EXISTS allowance ( id SERIAL PRIMARY KEY, personal FLOAT, maxKReceipt FLOAT);`
-	_, err = DB.Exec(createTb)
-	if err != nil {
-		log.Fatal("Create table failed", err)
+	if err = initTaxYears(DB); err != nil {
+		log.Fatal("Create tax_years failed", err)
+	}
+	if err = initBrackets(DB); err != nil {
+		log.Fatal("Create tax_brackets failed", err)
+	}
+	if err = initExpenseRules(DB); err != nil {
+		log.Fatal("Create expense_rules failed", err)
+	}
+	if err = initBatches(DB); err != nil {
+		log.Fatal("Create tax_batches failed", err)
+	}
+}
+
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = $1)", table).Scan(&exists)
+	return exists, err
+}
+
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = $1 AND column_name = $2)", table, column).Scan(&exists)
+	return exists, err
+}
+
+// numericColumns converts money columns created as FLOAT by earlier
+// versions to NUMERIC so amounts are stored to the exact satang.
+func numericColumns(db *sql.DB, table string, columns ...string) error {
+	for _, column := range columns {
+		var dataType string
+		err := db.QueryRow("SELECT data_type FROM information_schema.columns WHERE table_name = $1 AND column_name = $2", table, column).Scan(&dataType)
+		if err != nil {
+			return err
+		}
+		if dataType == "numeric" {
+			continue
+		}
+		alter := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE NUMERIC(15,2) USING ROUND(%s::numeric, 2)", table, column, column)
+		if _, err := db.Exec(alter); err != nil {
+			return err
+		}
 	}
-	DB.QueryRow("INSERT INTO allowance (personal, maxKReceipt) values ($1, $2) RETURNING id", 60000, 50000)
+	return nil
 }
 
-func GetPersonal(db *sql.DB) (float64, error) {
-	var personalAllowance float64
-	err := db.QueryRow("SELECT personal FROM allowance WHERE id = $1", 1).Scan(&personalAllowance)
+func GetPersonal(db *sql.DB, taxYear int) (handler.Money, error) {
+	var personalAllowance handler.Money
+	err := db.QueryRow("SELECT personal FROM tax_years WHERE year = $1", taxYear).Scan(&personalAllowance)
 	if err != nil {
-		return 0, fmt.Errorf("GetPersonal failed: %v", err)
+		return 0, fmt.Errorf("GetPersonal failed: %w", taxYearError(err, taxYear))
 	}
 	personalAllowance = ValidatePersonal(personalAllowance)
 	return personalAllowance, nil
 }
 
-func ValidatePersonal(amount float64) float64 {
-	if amount > 100000 {
-		return (100000)
-	} else if amount <= 10000 {
-		return (10001)
+func ValidatePersonal(amount handler.Money) handler.Money {
+	if amount > handler.Baht(100000) {
+		return handler.Baht(100000)
+	} else if amount <= handler.Baht(10000) {
+		return handler.Baht(10001)
 	} else {
 		return (amount)
 	}
 }
 
-func UpdatePersonal(c echo.Context, data DataStruct) error {
+func UpdatePersonal(c echo.Context) error {
 	db := DB
 	var request handler.RequestDeduction
 	if err := c.Bind(&request); err != nil {
 		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
 	}
+	taxYear := TaxYearOrDefault(request.TaxYear)
 	personalAllowance := ValidatePersonal(request.Amount)
-	data.PersonalAllowance = request.Amount
-	stmt, err := db.Prepare(`UPDATE allowance SET personal = $1`)
+	stmt, err := db.Prepare(`UPDATE tax_years SET personal = $1 WHERE year = $2`)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
 	}
-	if _, err := stmt.Exec(personalAllowance); err != nil {
+	result, err := stmt.Exec(personalAllowance, taxYear)
+	if err != nil {
 		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
 	}
-	response := map[string]float64{"personalDeduction": personalAllowance}
-	return c.JSON(http.StatusOK, response)
-}
-
-func GetMaxKReceipt(db *sql.DB) (float64, error) {
-	var maxKReceiptAllowance float64
-	err := db.QueryRow("SELECT maxKReceipt FROM allowance WHERE id = $1", 1).Scan(&maxKReceiptAllowance)
-	if err != nil {
-		return 0, fmt.Errorf("GetMaxKReceipt failed: %v", err)
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.JSON(http.StatusBadRequest, Err{Message: taxYearError(sql.ErrNoRows, taxYear).Error()})
 	}
-	maxKReceiptAllowance = ValidateMaxKReceipt(maxKReceiptAllowance)
-	return maxKReceiptAllowance, nil
+	response := map[string]handler.Money{"personalDeduction": personalAllowance}
+	return c.JSON(http.StatusOK, response)
 }
 
-func ValidateMaxKReceipt(amount float64) float64 {
-	if amount > 100000 {
-		return (100000)
+func ValidateMaxKReceipt(amount handler.Money) handler.Money {
+	if amount > handler.Baht(100000) {
+		return handler.Baht(100000)
 	} else if amount <= 0 {
-		return (1)
+		return handler.Baht(1)
 	} else {
 		return (amount)
 	}
 }
 
-func UpdateMaxKReceipt(c echo.Context, data DataStruct) error {
+func UpdateMaxKReceipt(c echo.Context) error {
 	db := DB
 	var request handler.RequestDeduction
 	if err := c.Bind(&request); err != nil {
 		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
 	}
+	taxYear := TaxYearOrDefault(request.TaxYear)
 	maxKReceipt := ValidateMaxKReceipt(request.Amount)
-	data.MaxKReceipt = request.Amount
-	stmt, err := db.Prepare(`UPDATE allowance SET maxKReceipt = $1`)
+	stmt, err := db.Prepare(`UPDATE allowance_rules SET amount = $1 WHERE tax_year = $2 AND allowance_type = 'k-receipt'`)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
 	}
-	if _, err := stmt.Exec(maxKReceipt); err != nil {
+	result, err := stmt.Exec(maxKReceipt, taxYear)
+	if err != nil {
 		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
 	}
-	response := map[string]float64{"kReceipt": maxKReceipt}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM tax_years WHERE year = $1)", taxYear).Scan(&exists); err != nil {
+			return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+		}
+		if exists {
+			return c.JSON(http.StatusNotFound, Err{Message: fmt.Errorf("%w: %d", ErrNoKReceiptRule, taxYear).Error()})
+		}
+		return c.JSON(http.StatusBadRequest, Err{Message: taxYearError(sql.ErrNoRows, taxYear).Error()})
+	}
+	response := map[string]handler.Money{"kReceipt": maxKReceipt}
 	return c.JSON(http.StatusOK, response)
 }
@@ -2,64 +2,185 @@ package database
 
 import (
 	"testing"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
 )
 
 func TestValidatePersonal(t *testing.T) {
 	t.Run("should return 100000", func(t *testing.T) {
-		amount := 200000
+		amount := handler.Baht(200000)
 
-		got := ValidatePersonal(float64(amount))
+		got := ValidatePersonal(amount)
 
-		if got != 100000.0 {
-			t.Errorf("expected %f, but got %f", 100000.0, got)
+		if got != handler.Baht(100000) {
+			t.Errorf("expected %v, but got %v", handler.Baht(100000), got)
 		}
 	})
 	t.Run("should return 15000", func(t *testing.T) {
-		amount := 15000
+		amount := handler.Baht(15000)
 
-		got := ValidatePersonal(float64(amount))
+		got := ValidatePersonal(amount)
 
-		if got != 15000.0 {
-			t.Errorf("expected %f, but got %f", 15000.0, got)
+		if got != handler.Baht(15000) {
+			t.Errorf("expected %v, but got %v", handler.Baht(15000), got)
 		}
 	})
 	t.Run("should return 10001", func(t *testing.T) {
-		amount := 200
+		amount := handler.Baht(200)
 
-		got := ValidatePersonal(float64(amount))
+		got := ValidatePersonal(amount)
 
-		if got != 10001.0 {
-			t.Errorf("expected %f, but got %f", 10001.0, got)
+		if got != handler.Baht(10001) {
+			t.Errorf("expected %v, but got %v", handler.Baht(10001), got)
 		}
 	})
 }
 
 func TestValidateMaxKReceipt(t *testing.T) {
 	t.Run("should return 100000", func(t *testing.T) {
-		amount := 200000
+		amount := handler.Baht(200000)
 
-		got := ValidateMaxKReceipt(float64(amount))
+		got := ValidateMaxKReceipt(amount)
 
-		if got != 100000.0 {
-			t.Errorf("expected %f, but got %f", 100000.0, got)
+		if got != handler.Baht(100000) {
+			t.Errorf("expected %v, but got %v", handler.Baht(100000), got)
 		}
 	})
 	t.Run("should return 1", func(t *testing.T) {
-		amount := -15000
+		amount := handler.Baht(-15000)
 
-		got := ValidateMaxKReceipt(float64(amount))
+		got := ValidateMaxKReceipt(amount)
 
-		if got != 1.0 {
-			t.Errorf("expected %f, but got %f", 1.0, got)
+		if got != handler.Baht(1) {
+			t.Errorf("expected %v, but got %v", handler.Baht(1), got)
 		}
 	})
 	t.Run("should return 1500", func(t *testing.T) {
-		amount := 1500
+		amount := handler.Baht(1500)
+
+		got := ValidateMaxKReceipt(amount)
+
+		if got != handler.Baht(1500) {
+			t.Errorf("expected %v, but got %v", handler.Baht(1500), got)
+		}
+	})
+}
+
+func TestValidateBrackets(t *testing.T) {
+	t.Run("should accept default brackets", func(t *testing.T) {
+		if err := ValidateBrackets(DefaultBrackets()); err != nil {
+			t.Errorf("expected no error, but got %v", err)
+		}
+	})
+	t.Run("should reject gap between brackets", func(t *testing.T) {
+		brackets := DefaultBrackets()
+		brackets[1].MinAmount = handler.Baht(160000)
 
-		got := ValidateMaxKReceipt(float64(amount))
+		if err := ValidateBrackets(brackets); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+	t.Run("should reject decreasing rate", func(t *testing.T) {
+		brackets := DefaultBrackets()
+		brackets[2].Rate = 0.05
+
+		if err := ValidateBrackets(brackets); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+	t.Run("should reject bounded last bracket", func(t *testing.T) {
+		brackets := DefaultBrackets()[:2]
+
+		if err := ValidateBrackets(brackets); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+	t.Run("should reject not starting at 0", func(t *testing.T) {
+		brackets := DefaultBrackets()[1:]
+
+		if err := ValidateBrackets(brackets); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+}
+
+func TestValidateAllowanceRules(t *testing.T) {
+	t.Run("should accept default rules", func(t *testing.T) {
+		if err := ValidateAllowanceRules(DefaultAllowanceRules(), DefaultAllowanceGroups()); err != nil {
+			t.Errorf("expected no error, but got %v", err)
+		}
+	})
+	t.Run("should reject unknown group", func(t *testing.T) {
+		rules := []handler.AllowanceRule{{AllowanceType: "rmf", CapType: handler.CapGroup, Group: "retirement"}}
+
+		if err := ValidateAllowanceRules(rules, nil); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+	t.Run("should reject percentage without rate", func(t *testing.T) {
+		rules := []handler.AllowanceRule{{AllowanceType: "rmf", CapType: handler.CapIncomePercent}}
+
+		if err := ValidateAllowanceRules(rules, nil); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+	t.Run("should reject unknown capType", func(t *testing.T) {
+		rules := []handler.AllowanceRule{{AllowanceType: "rmf", CapType: "monthly"}}
+
+		if err := ValidateAllowanceRules(rules, nil); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+}
+
+func TestValidateExpenseRules(t *testing.T) {
+	t.Run("should accept default rules", func(t *testing.T) {
+		if err := ValidateExpenseRules(DefaultExpenseRules(), handler.IncomeCategories); err != nil {
+			t.Errorf("expected no error, but got %v", err)
+		}
+	})
+	t.Run("should reject unknown category", func(t *testing.T) {
+		rules := []handler.ExpenseRule{{Category: "40(9)", Rate: 0.5}}
+
+		if err := ValidateExpenseRules(rules, handler.IncomeCategories); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+	t.Run("should reject group with different caps", func(t *testing.T) {
+		rules := DefaultExpenseRules()
+		rules[1].Amount = handler.Baht(50000)
+
+		if err := ValidateExpenseRules(rules, handler.IncomeCategories); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+}
+
+func TestValidateMinimumTax(t *testing.T) {
+	t.Run("should accept default minimum tax", func(t *testing.T) {
+		if err := ValidateMinimumTax(DefaultMinimumTax()); err != nil {
+			t.Errorf("expected no error, but got %v", err)
+		}
+	})
+	t.Run("should reject rate above 1", func(t *testing.T) {
+		if err := ValidateMinimumTax(handler.MinimumTax{Rate: 5}); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+}
+
+func TestValidateDependentRules(t *testing.T) {
+	t.Run("should accept default rules", func(t *testing.T) {
+		if err := ValidateDependentRules(DefaultDependentRules()); err != nil {
+			t.Errorf("expected no error, but got %v", err)
+		}
+	})
+	t.Run("should reject negative amount", func(t *testing.T) {
+		rules := DefaultDependentRules()
+		rules.Parent = handler.Baht(-1)
 
-		if got != 1500.0 {
-			t.Errorf("expected %f, but got %f", 1500.0, got)
+		if err := ValidateDependentRules(rules); err == nil {
+			t.Errorf("expected error, but got nil")
 		}
 	})
 }
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+func DefaultDependentRules() handler.DependentRules {
+	return handler.DependentRules{
+		Spouse:             handler.Baht(60000),
+		Child:              handler.Baht(30000),
+		ChildBonus:         handler.Baht(60000),
+		ChildBonusFromYear: 2561,
+		Parent:             handler.Baht(30000),
+		ParentMinAge:       60,
+		Disabled:           handler.Baht(60000),
+	}
+}
+
+func initDependentRules(db *sql.DB) error {
+	rules := DefaultDependentRules()
+	addColumns := fmt.Sprintf(`ALTER TABLE tax_years
+		ADD COLUMN IF NOT EXISTS spouse_allowance NUMERIC(15,2) NOT NULL DEFAULT %v,
+		ADD COLUMN IF NOT EXISTS child_allowance NUMERIC(15,2) NOT NULL DEFAULT %v,
+		ADD COLUMN IF NOT EXISTS child_bonus_allowance NUMERIC(15,2) NOT NULL DEFAULT %v,
+		ADD COLUMN IF NOT EXISTS child_bonus_from_year INT NOT NULL DEFAULT %d,
+		ADD COLUMN IF NOT EXISTS parent_allowance NUMERIC(15,2) NOT NULL DEFAULT %v,
+		ADD COLUMN IF NOT EXISTS parent_min_age INT NOT NULL DEFAULT %d,
+		ADD COLUMN IF NOT EXISTS disabled_allowance NUMERIC(15,2) NOT NULL DEFAULT %v;`,
+		rules.Spouse, rules.Child, rules.ChildBonus, rules.ChildBonusFromYear, rules.Parent, rules.ParentMinAge, rules.Disabled)
+	_, err := db.Exec(addColumns)
+	return err
+}
+
+func GetDependentRules(db *sql.DB, taxYear int) (handler.DependentRules, error) {
+	var rules handler.DependentRules
+	query := `SELECT spouse_allowance, child_allowance, child_bonus_allowance, child_bonus_from_year, parent_allowance, parent_min_age, disabled_allowance
+		FROM tax_years WHERE year = $1`
+	err := db.QueryRow(query, taxYear).Scan(&rules.Spouse, &rules.Child, &rules.ChildBonus, &rules.ChildBonusFromYear, &rules.Parent, &rules.ParentMinAge, &rules.Disabled)
+	if err != nil {
+		return rules, fmt.Errorf("GetDependentRules failed: %w", taxYearError(err, taxYear))
+	}
+	return rules, nil
+}
+
+func updateDependentRules(db execer, taxYear int, rules handler.DependentRules) error {
+	update := `UPDATE tax_years SET spouse_allowance = $2, child_allowance = $3, child_bonus_allowance = $4, child_bonus_from_year = $5,
+		parent_allowance = $6, parent_min_age = $7, disabled_allowance = $8 WHERE year = $1`
+	_, err := db.Exec(update, taxYear, rules.Spouse, rules.Child, rules.ChildBonus, rules.ChildBonusFromYear, rules.Parent, rules.ParentMinAge, rules.Disabled)
+	return err
+}
+
+func ValidateDependentRules(rules handler.DependentRules) error {
+	for name, amount := range map[string]handler.Money{"spouse": rules.Spouse, "child": rules.Child, "childBonus": rules.ChildBonus, "parent": rules.Parent, "disabled": rules.Disabled} {
+		if amount < 0 {
+			return fmt.Errorf("dependents %s must not be negative", name)
+		}
+	}
+	if rules.ParentMinAge < 0 {
+		return fmt.Errorf("dependents parentMinAge must not be negative")
+	}
+	return nil
+}
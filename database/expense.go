@@ -0,0 +1,168 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+// DefaultExpenseRules are the flat-rate expenses of the Revenue Code. 40(5)
+// to 40(8) may claim actual expenses instead; the rates used are the ones
+// that apply to most income of each category.
+func DefaultExpenseRules() []handler.ExpenseRule {
+	return []handler.ExpenseRule{
+		{Category: "40(1)", Rate: 0.5, Amount: handler.Baht(100000), Group: "employment"},
+		{Category: "40(2)", Rate: 0.5, Amount: handler.Baht(100000), Group: "employment"},
+		{Category: "40(3)", Rate: 0.5, Amount: handler.Baht(100000)},
+		{Category: "40(4)", Rate: 0},
+		{Category: "40(5)", Rate: 0.3, Actual: true},
+		{Category: "40(6)", Rate: 0.3, Actual: true},
+		{Category: "40(7)", Rate: 0.6, Actual: true},
+		{Category: "40(8)", Rate: 0.6, Actual: true},
+	}
+}
+
+func initExpenseRules(db *sql.DB) error {
+	createTb := `CREATE TABLE IF NOT EXISTS expense_rules ( tax_year INT NOT NULL, category TEXT NOT NULL, rate FLOAT NOT NULL DEFAULT 0,
+		amount NUMERIC(15,2) NOT NULL DEFAULT 0, expense_group TEXT NOT NULL DEFAULT '', actual BOOLEAN NOT NULL DEFAULT FALSE, PRIMARY KEY (tax_year, category));`
+	if _, err := db.Exec(createTb); err != nil {
+		return err
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM expense_rules WHERE tax_year = $1", DefaultTaxYear).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	for _, rule := range DefaultExpenseRules() {
+		if err := upsertExpenseRule(db, DefaultTaxYear, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func upsertExpenseRule(db execer, taxYear int, rule handler.ExpenseRule) error {
+	upsert := `INSERT INTO expense_rules (tax_year, category, rate, amount, expense_group, actual) values ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (tax_year, category) DO UPDATE SET rate = $3, amount = $4, expense_group = $5, actual = $6`
+	_, err := db.Exec(upsert, taxYear, rule.Category, rule.Rate, rule.Amount, rule.Group, rule.Actual)
+	return err
+}
+
+func replaceExpenseRules(db execer, taxYear int, rules []handler.ExpenseRule) error {
+	if _, err := db.Exec("DELETE FROM expense_rules WHERE tax_year = $1", taxYear); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := upsertExpenseRule(db, taxYear, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetExpenseRules(db *sql.DB, taxYear int) ([]handler.ExpenseRule, error) {
+	rows, err := db.Query("SELECT category, rate, amount, expense_group, actual FROM expense_rules WHERE tax_year = $1 ORDER BY category", taxYear)
+	if err != nil {
+		return nil, fmt.Errorf("GetExpenseRules failed: %v", err)
+	}
+	defer rows.Close()
+	var rules []handler.ExpenseRule
+	for rows.Next() {
+		var rule handler.ExpenseRule
+		if err := rows.Scan(&rule.Category, &rule.Rate, &rule.Amount, &rule.Group, &rule.Actual); err != nil {
+			return nil, fmt.Errorf("GetExpenseRules failed: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetExpenseRules failed: %v", err)
+	}
+	return rules, nil
+}
+
+// ValidateExpenseRules checks that every category is known and configured
+// once, and that the categories of a group share the same rate and cap.
+func ValidateExpenseRules(rules []handler.ExpenseRule, categories []string) error {
+	seen := map[string]bool{}
+	groups := map[string]handler.ExpenseRule{}
+	for _, rule := range rules {
+		if !slices.Contains(categories, rule.Category) {
+			return fmt.Errorf("unsupported category %q", rule.Category)
+		}
+		if seen[rule.Category] {
+			return fmt.Errorf("category %s is defined twice", rule.Category)
+		}
+		seen[rule.Category] = true
+		if rule.Rate < 0 || rule.Rate > 1 {
+			return fmt.Errorf("%s rate must be between 0 and 1", rule.Category)
+		}
+		if rule.Amount < 0 {
+			return fmt.Errorf("%s amount must not be negative", rule.Category)
+		}
+		if rule.Group == "" {
+			continue
+		}
+		if first, ok := groups[rule.Group]; ok && (first.Rate != rule.Rate || first.Amount != rule.Amount || first.Actual != rule.Actual) {
+			return fmt.Errorf("%s must have the same rate, amount and actual as %s in group %s", rule.Category, first.Category, rule.Group)
+		} else if !ok {
+			groups[rule.Group] = rule
+		}
+	}
+	return nil
+}
+
+func ListExpenseRules(c echo.Context) error {
+	taxYear, err := QueryTaxYear(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := checkTaxYear(taxYear); err != nil {
+		return taxYearResponse(c, err)
+	}
+	rules, err := GetExpenseRules(DB, taxYear)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, handler.RequestExpenses{Expenses: rules})
+}
+
+func UpdateExpenseRule(c echo.Context) error {
+	taxYear, err := QueryTaxYear(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	var request handler.ExpenseRule
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	request.Category = c.Param("category")
+	if err := checkTaxYear(taxYear); err != nil {
+		return taxYearResponse(c, err)
+	}
+	rules, err := GetExpenseRules(DB, taxYear)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	replaced := false
+	for i := range rules {
+		if rules[i].Category == request.Category {
+			rules[i], replaced = request, true
+		}
+	}
+	if !replaced {
+		rules = append(rules, request)
+	}
+	if err := ValidateExpenseRules(rules, handler.IncomeCategories); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := upsertExpenseRule(DB, taxYear, request); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, request)
+}
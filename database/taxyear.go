@@ -0,0 +1,226 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+const DefaultTaxYear = 2567
+
+var ErrUnknownTaxYear = errors.New("unknown tax year")
+
+// Loader returns the rule set that applies to a tax year, or an error
+// wrapping ErrUnknownTaxYear when no rules are stored for it.
+type Loader func(taxYear int) (DataStruct, error)
+
+func DefaultMinimumTax() handler.MinimumTax {
+	return handler.MinimumTax{Rate: 0.005, Threshold: handler.Baht(120000)}
+}
+
+func TaxYearOrDefault(taxYear int) int {
+	if taxYear == 0 {
+		return DefaultTaxYear
+	}
+	return taxYear
+}
+
+func taxYearError(err error, taxYear int) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %d", ErrUnknownTaxYear, taxYear)
+	}
+	return err
+}
+
+func initTaxYears(db *sql.DB) error {
+	createTb := `CREATE TABLE IF NOT EXISTS tax_years ( year INT PRIMARY KEY, personal NUMERIC(15,2) NOT NULL);`
+	if _, err := db.Exec(createTb); err != nil {
+		return err
+	}
+	if err := initAllowanceRules(db); err != nil {
+		return err
+	}
+	if err := numericColumns(db, "tax_years", "personal"); err != nil {
+		return err
+	}
+	minimum := DefaultMinimumTax()
+	addMinimum := fmt.Sprintf(`ALTER TABLE tax_years ADD COLUMN IF NOT EXISTS min_tax_rate FLOAT NOT NULL DEFAULT %v,
+		ADD COLUMN IF NOT EXISTS min_tax_threshold NUMERIC(15,2) NOT NULL DEFAULT %v;`, minimum.Rate, minimum.Threshold)
+	if _, err := db.Exec(addMinimum); err != nil {
+		return err
+	}
+	if err := initDependentRules(db); err != nil {
+		return err
+	}
+	// Carry over values an admin set in the single-year allowance table.
+	legacy, err := tableExists(db, "allowance")
+	if err != nil {
+		return err
+	}
+	if legacy {
+		migrate := `INSERT INTO tax_years (year, personal) SELECT $1, personal FROM allowance WHERE id = 1 ON CONFLICT (year) DO NOTHING`
+		if err := seed(db, "migrate:legacy-personal", migrate, DefaultTaxYear); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("INSERT INTO tax_years (year, personal) values ($1, $2) ON CONFLICT (year) DO NOTHING", DefaultTaxYear, handler.Baht(60000))
+	return err
+}
+
+func GetMinimumTax(db *sql.DB, taxYear int) (handler.MinimumTax, error) {
+	var minimum handler.MinimumTax
+	err := db.QueryRow("SELECT min_tax_rate, min_tax_threshold FROM tax_years WHERE year = $1", taxYear).Scan(&minimum.Rate, &minimum.Threshold)
+	if err != nil {
+		return minimum, fmt.Errorf("GetMinimumTax failed: %w", taxYearError(err, taxYear))
+	}
+	return minimum, nil
+}
+
+func ValidateMinimumTax(minimum handler.MinimumTax) error {
+	if minimum.Rate < 0 || minimum.Rate > 1 {
+		return fmt.Errorf("minimumTax rate must be between 0 and 1")
+	}
+	if minimum.Threshold < 0 {
+		return fmt.Errorf("minimumTax threshold must not be negative")
+	}
+	return nil
+}
+
+func checkTaxYear(taxYear int) error {
+	var exists bool
+	if err := DB.QueryRow("SELECT EXISTS (SELECT 1 FROM tax_years WHERE year = $1)", taxYear).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return taxYearError(sql.ErrNoRows, taxYear)
+	}
+	return nil
+}
+
+func taxYearResponse(c echo.Context, err error) error {
+	if errors.Is(err, ErrUnknownTaxYear) {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+}
+
+func QueryTaxYear(c echo.Context) (int, error) {
+	param := c.QueryParam("taxYear")
+	if param == "" {
+		return DefaultTaxYear, nil
+	}
+	taxYear, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, fmt.Errorf("invalid taxYear: %v", param)
+	}
+	return taxYear, nil
+}
+
+func ListTaxYears(c echo.Context) error {
+	rows, err := DB.Query("SELECT year, personal, min_tax_rate, min_tax_threshold FROM tax_years ORDER BY year")
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	defer rows.Close()
+	response := []handler.TaxYearRules{}
+	for rows.Next() {
+		rules := handler.TaxYearRules{MinimumTax: &handler.MinimumTax{}}
+		if err := rows.Scan(&rules.TaxYear, &rules.PersonalDeduction, &rules.MinimumTax.Rate, &rules.MinimumTax.Threshold); err != nil {
+			return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+		}
+		response = append(response, rules)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	for i := range response {
+		if response[i].Allowances, err = GetAllowanceRules(DB, response[i].TaxYear); err != nil {
+			return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+		}
+		if response[i].Groups, err = GetAllowanceGroups(DB, response[i].TaxYear); err != nil {
+			return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+		}
+		if response[i].Expenses, err = GetExpenseRules(DB, response[i].TaxYear); err != nil {
+			return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+		}
+		dependents, err := GetDependentRules(DB, response[i].TaxYear)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+		}
+		response[i].Dependents = &dependents
+		if response[i].Brackets, err = GetBrackets(DB, response[i].TaxYear); err != nil {
+			return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+		}
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func ReplaceTaxYear(c echo.Context) error {
+	taxYear, err := strconv.Atoi(c.Param("year"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: "invalid tax year: " + c.Param("year")})
+	}
+	var request handler.TaxYearRules
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := ValidateBrackets(request.Brackets); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := ValidateAllowanceRules(request.Allowances, request.Groups); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err := ValidateExpenseRules(request.Expenses, handler.IncomeCategories); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if request.MinimumTax == nil {
+		minimum := DefaultMinimumTax()
+		request.MinimumTax = &minimum
+	}
+	if err := ValidateMinimumTax(*request.MinimumTax); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if request.Dependents == nil {
+		dependents := DefaultDependentRules()
+		request.Dependents = &dependents
+	}
+	if err := ValidateDependentRules(*request.Dependents); err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	request.TaxYear = taxYear
+	request.PersonalDeduction = ValidatePersonal(request.PersonalDeduction)
+	tx, err := DB.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	defer tx.Rollback()
+	upsert := `INSERT INTO tax_years (year, personal, min_tax_rate, min_tax_threshold) values ($1, $2, $3, $4)
+		ON CONFLICT (year) DO UPDATE SET personal = $2, min_tax_rate = $3, min_tax_threshold = $4`
+	if _, err := tx.Exec(upsert, taxYear, request.PersonalDeduction, request.MinimumTax.Rate, request.MinimumTax.Threshold); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	if err := replaceAllowances(tx, taxYear, request.Allowances, request.Groups); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	if err := updateDependentRules(tx, taxYear, *request.Dependents); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	if err := replaceExpenseRules(tx, taxYear, request.Expenses); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	if _, err := tx.Exec("DELETE FROM tax_brackets WHERE tax_year = $1", taxYear); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	if err := insertBrackets(tx, taxYear, request.Brackets); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, request)
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -16,11 +17,6 @@ import (
 )
 
 func main() {
-	var err error
-	data := database.DataStruct{
-		PersonalAllowance: 60000.0,
-		MaxKReceipt:       50000.0,
-	}
 	database.Init()
 
 	e := echo.New()
@@ -28,28 +24,57 @@ func main() {
 	e.Use(middleware.Recover())
 
 	e.POST("/tax/calculations", func(c echo.Context) error {
-		data, err = UpdateData(data)
-		if err != nil {
-			return err
-		}
-		return service.Calculate(c, data)
+		return service.Calculate(c, UpdateData)
+	})
+	e.POST("/tax/optimize", func(c echo.Context) error {
+		return service.Optimize(c, UpdateData)
+	})
+	e.POST("/tax/compare", func(c echo.Context) error {
+		return service.Compare(c, UpdateData)
+	})
+	e.POST("/tax/bonus", func(c echo.Context) error {
+		return service.Bonus(c, UpdateData)
+	})
+	e.POST("/tax/reverse", func(c echo.Context) error {
+		return service.Reverse(c, UpdateData)
+	})
+	e.GET("/tax/curve", func(c echo.Context) error {
+		return service.TaxCurve(c, UpdateData)
 	})
+	e.POST("/payroll/withholding", func(c echo.Context) error {
+		return service.Withholding(c, UpdateData)
+	})
+	limits := CsvLimits()
 	e.POST("/tax/calculations/upload-csv", func(c echo.Context) error {
-		data, err = UpdateData(data)
-		if err != nil {
-			return err
-		}
-		return service.Csv(c, data)
+		return service.Csv(c, UpdateData, limits)
 	})
 
+	batches := service.NewBatches(database.BatchStore{DB: database.DB}, UpdateData, limits)
+	if v, err := strconv.Atoi(os.Getenv("BATCH_WORKERS")); err == nil && v > 0 {
+		batches.Workers = v
+	}
+	if err := batches.Start(context.Background()); err != nil {
+		e.Logger.Fatal(err)
+	}
+	e.POST("/tax/batches", batches.Submit)
+	e.GET("/tax/batches/:id", batches.Status)
+	e.GET("/tax/batches/:id/results", batches.Results)
+
 	g := e.Group("/admin")
 	g.Use(middleware.BasicAuth(AuthMiddleware))
-	g.POST("/deductions/personal", func(c echo.Context) error {
-		return database.UpdatePersonal(c, data)
-	})
-	g.POST("/deductions/k-receipt", func(c echo.Context) error {
-		return database.UpdateMaxKReceipt(c, data)
-	})
+	g.POST("/deductions/personal", database.UpdatePersonal)
+	g.POST("/deductions/k-receipt", database.UpdateMaxKReceipt)
+	g.POST("/deductions/:allowanceType", database.UpdateDeduction)
+	g.GET("/allowances", database.ListAllowances)
+	g.PUT("/allowances/:allowanceType", database.UpdateAllowanceRule)
+	g.PUT("/allowance-groups/:name", database.UpdateAllowanceGroup)
+	g.GET("/expenses", database.ListExpenseRules)
+	g.PUT("/expenses/:category", database.UpdateExpenseRule)
+	g.GET("/tax-years", database.ListTaxYears)
+	g.PUT("/tax-years/:year", database.ReplaceTaxYear)
+	g.GET("/brackets", database.ListBrackets)
+	g.PUT("/brackets", database.ReplaceBrackets)
+	g.POST("/brackets/validate", database.CheckBrackets)
 
 	go func() {
 		if err := e.Start(":" + os.Getenv("PORT")); err != nil && err != http.ErrServerClosed {
@@ -65,6 +90,7 @@ func main() {
 	if err := e.Shutdown(ctx); err != nil {
 		e.Logger.Fatal(err)
 	}
+	batches.Stop()
 	fmt.Println("\nshutting down the server")
 }
 
@@ -78,15 +104,52 @@ func AuthMiddleware(username, password string, c echo.Context) (bool, error) {
 	return false, nil
 }
 
-func UpdateData(data database.DataStruct) (database.DataStruct, error) {
+// CsvLimits reads the CSV upload limits from CSV_MAX_BYTES, CSV_MAX_ROWS
+// and CSV_WORKERS, keeping the defaults for unset or invalid values.
+func CsvLimits() service.CsvLimits {
+	limits := service.DefaultCsvLimits()
+	if v, err := strconv.ParseInt(os.Getenv("CSV_MAX_BYTES"), 10, 64); err == nil && v > 0 {
+		limits.MaxBytes = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("CSV_MAX_ROWS")); err == nil && v > 0 {
+		limits.MaxRows = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("CSV_WORKERS")); err == nil && v > 0 {
+		limits.Workers = v
+	}
+	return limits
+}
+
+func UpdateData(taxYear int) (database.DataStruct, error) {
 	var err error
-	data.PersonalAllowance, err = database.GetPersonal(database.DB)
+	data := database.DataStruct{TaxYear: taxYear}
+	data.PersonalAllowance, err = database.GetPersonal(database.DB, taxYear)
+	if err != nil {
+		return data, fmt.Errorf("GetPersonal error: %w", err)
+	}
+	data.Allowances, err = database.GetAllowanceRules(database.DB, taxYear)
+	if err != nil {
+		return data, fmt.Errorf("GetAllowanceRules error: %w", err)
+	}
+	data.Groups, err = database.GetAllowanceGroups(database.DB, taxYear)
+	if err != nil {
+		return data, fmt.Errorf("GetAllowanceGroups error: %w", err)
+	}
+	data.MinimumTax, err = database.GetMinimumTax(database.DB, taxYear)
+	if err != nil {
+		return data, fmt.Errorf("GetMinimumTax error: %w", err)
+	}
+	data.Dependents, err = database.GetDependentRules(database.DB, taxYear)
+	if err != nil {
+		return data, fmt.Errorf("GetDependentRules error: %w", err)
+	}
+	data.Expenses, err = database.GetExpenseRules(database.DB, taxYear)
 	if err != nil {
-		return data, fmt.Errorf("GetPersonal error: %v", err)
+		return data, fmt.Errorf("GetExpenseRules error: %w", err)
 	}
-	data.MaxKReceipt, err = database.GetMaxKReceipt(database.DB)
+	data.Brackets, err = database.GetBrackets(database.DB, taxYear)
 	if err != nil {
-		return data, fmt.Errorf("GetMaxKReceipt error: %v", err)
+		return data, fmt.Errorf("GetBrackets error: %w", err)
 	}
 	return data, nil
 }
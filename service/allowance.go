@@ -0,0 +1,137 @@
+package service
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+// AllowanceResult is one requested allowanceType after its caps. CappedBy
+// names the cap type that reduced it, or is empty when nothing did.
+// LostToGroup is what the rule's own cap allowed but its group did not.
+type AllowanceResult struct {
+	AllowanceType string
+	Subtype       string
+	Requested     handler.Money
+	Deductible    handler.Money
+	LostToGroup   handler.Money
+	CappedBy      string
+}
+
+// ApplyAllowances evaluates the allowance registry of data against the
+// requested allowances. Repeated entries of a type and subtype are added
+// together before they are capped. Rules are evaluated in registry order,
+// which is also the order group caps are filled in, except that rules with
+// a higher multiplier go first so qualifying donations are deducted before
+// general ones, and that netIncomePercent rules and rules of a group with
+// a rate go last because they depend on the net income left after every
+// other deduction, including those taken before allowances such as the
+// expense deduction and family allowances. Types without a rule are never
+// deducted; callers reject them first with ValidateAllowances.
+func ApplyAllowances(data database.DataStruct, totalIncome, deductedBefore handler.Money, allowances []handler.AllowancesArr) []AllowanceResult {
+	requested := map[string]handler.Money{}
+	for _, a := range allowances {
+		requested[a.Key()] += a.Amount
+	}
+	groupRoom := map[string]handler.Money{}
+	netGroups := map[string]handler.AllowanceGroup{}
+	for _, group := range data.Groups {
+		if group.Rate > 0 {
+			netGroups[group.Name] = group
+		}
+		groupRoom[group.Name] = group.Amount
+	}
+
+	rules := slices.Clone(data.Allowances)
+	slices.SortStableFunc(rules, func(a, b handler.AllowanceRule) int {
+		return cmp.Compare(b.MultiplierOrOne(), a.MultiplierOrOne())
+	})
+
+	var results []AllowanceResult
+	var deducted handler.Money
+	for _, netPass := range []bool{false, true} {
+		netIncome := totalIncome - deductedBefore - data.PersonalAllowance - deducted
+		if netPass {
+			for name, group := range netGroups {
+				room := max(netIncome, 0).MulRate(group.Rate)
+				if group.Amount > 0 {
+					room = min(room, group.Amount)
+				}
+				groupRoom[name] = room
+			}
+		}
+		for _, rule := range rules {
+			_, netGroup := netGroups[rule.Group]
+			if (rule.CapType == handler.CapNetIncomePercent || netGroup) != netPass {
+				continue
+			}
+			amount, ok := requested[rule.Key()]
+			if !ok {
+				continue
+			}
+			result := CapAllowance(rule, amount, totalIncome, netIncome, groupRoom)
+			deducted += result.Deductible
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// ValidateAllowances checks every requested allowance against the registry
+// of data and returns one error per offending field. Repeated entries of a
+// supported type are allowed and merged by ApplyAllowances.
+func ValidateAllowances(data database.DataStruct, allowances []handler.AllowancesArr) []handler.ValidationErr {
+	supported := map[string]bool{}
+	for _, rule := range data.Allowances {
+		supported[rule.AllowanceType] = true
+		supported[rule.Key()] = true
+	}
+	var errs []handler.ValidationErr
+	for i, a := range allowances {
+		if a.AllowanceType == "" {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "allowanceType", Reason: "allowanceType is required"})
+		} else if !supported[a.AllowanceType] {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "allowanceType", Reason: fmt.Sprintf("unsupported allowanceType %q", a.AllowanceType)})
+		} else if !supported[a.Key()] {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "subtype", Reason: fmt.Sprintf("unsupported subtype %q of %s", a.Subtype, a.AllowanceType)})
+		}
+		if a.Amount < 0 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "amount", Reason: "amount must not be negative"})
+		}
+	}
+	return errs
+}
+
+// CapAllowance counts one requested amount by the rule's multiplier, then
+// limits it by the rule and by the room left in the rule's group, which it
+// consumes.
+func CapAllowance(rule handler.AllowanceRule, requested, totalIncome, netIncome handler.Money, groupRoom map[string]handler.Money) AllowanceResult {
+	result := AllowanceResult{AllowanceType: rule.AllowanceType, Subtype: rule.Subtype, Requested: requested, Deductible: requested.MulRate(rule.MultiplierOrOne())}
+	limit := handler.MaxMoney
+	switch rule.CapType {
+	case handler.CapFixed:
+		limit = rule.Amount
+	case handler.CapIncomePercent:
+		limit = max(totalIncome, 0).MulRate(rule.Rate)
+	case handler.CapNetIncomePercent:
+		limit = max(netIncome, 0).MulRate(rule.Rate)
+	}
+	if rule.CapType != handler.CapFixed && rule.Amount > 0 {
+		limit = min(limit, rule.Amount)
+	}
+	if result.Deductible > limit {
+		result.Deductible, result.CappedBy = limit, rule.CapType
+	}
+	if rule.Group != "" {
+		room := groupRoom[rule.Group]
+		if result.Deductible > room {
+			result.LostToGroup = result.Deductible - max(room, 0)
+			result.Deductible, result.CappedBy = room, handler.CapGroup
+		}
+		groupRoom[rule.Group] = room - max(result.Deductible, 0)
+	}
+	return result
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+func TestApplyAllowances(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances: []handler.AllowanceRule{
+			{AllowanceType: "k-receipt", CapType: handler.CapFixed, Amount: handler.Baht(50000)},
+			{AllowanceType: "rmf", CapType: handler.CapIncomePercent, Rate: 0.30, Amount: handler.Baht(500000), Group: "retirement"},
+			{AllowanceType: "pvd", CapType: handler.CapGroup, Group: "retirement"},
+			{AllowanceType: "donation", CapType: handler.CapNetIncomePercent, Rate: 0.10},
+		},
+		Groups: []handler.AllowanceGroup{{Name: "retirement", Amount: handler.Baht(200000)}},
+	}
+	t.Run("should cap fixed amount", func(t *testing.T) {
+		got := ApplyAllowances(data, handler.Baht(500000), 0, []handler.AllowancesArr{
+			{AllowanceType: "k-receipt", Amount: handler.Baht(200000)},
+		})
+
+		want := []AllowanceResult{{AllowanceType: "k-receipt", Requested: handler.Baht(200000), Deductible: handler.Baht(50000), CappedBy: handler.CapFixed}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+	t.Run("should cap percentage of income and share group cap", func(t *testing.T) {
+		got := ApplyAllowances(data, handler.Baht(500000), 0, []handler.AllowancesArr{
+			{AllowanceType: "pvd", Amount: handler.Baht(100000)},
+			{AllowanceType: "rmf", Amount: handler.Baht(200000)},
+		})
+
+		want := []AllowanceResult{
+			{AllowanceType: "rmf", Requested: handler.Baht(200000), Deductible: handler.Baht(150000), CappedBy: handler.CapIncomePercent},
+			{AllowanceType: "pvd", Requested: handler.Baht(100000), Deductible: handler.Baht(50000), LostToGroup: handler.Baht(50000), CappedBy: handler.CapGroup},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+	t.Run("should cap percentage of net income after other deductions", func(t *testing.T) {
+		got := ApplyAllowances(data, handler.Baht(500000), 0, []handler.AllowancesArr{
+			{AllowanceType: "donation", Amount: handler.Baht(100000)},
+			{AllowanceType: "k-receipt", Amount: handler.Baht(40000)},
+		})
+
+		want := []AllowanceResult{
+			{AllowanceType: "k-receipt", Requested: handler.Baht(40000), Deductible: handler.Baht(40000)},
+			{AllowanceType: "donation", Requested: handler.Baht(100000), Deductible: handler.Baht(40000), CappedBy: handler.CapNetIncomePercent},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+	t.Run("should merge repeated types", func(t *testing.T) {
+		got := ApplyAllowances(data, handler.Baht(500000), 0, []handler.AllowancesArr{
+			{AllowanceType: "k-receipt", Amount: handler.Baht(30000)},
+			{AllowanceType: "k-receipt", Amount: handler.Baht(30000)},
+		})
+
+		if len(got) != 1 || got[0].Deductible != handler.Baht(50000) {
+			t.Errorf("expected %v but got %v", handler.Baht(50000), got)
+		}
+	})
+}
+
+func TestRetirementAllowances(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+	}
+
+	got := ApplyAllowances(data, handler.Baht(2000000), 0, []handler.AllowancesArr{
+		{AllowanceType: "thai-esg", Amount: handler.Baht(400000)},
+		{AllowanceType: "rmf", Amount: handler.Baht(400000)},
+		{AllowanceType: "pvd", Amount: handler.Baht(350000)},
+	})
+
+	want := []AllowanceResult{
+		{AllowanceType: "pvd", Requested: handler.Baht(350000), Deductible: handler.Baht(300000), CappedBy: handler.CapIncomePercent},
+		{AllowanceType: "rmf", Requested: handler.Baht(400000), Deductible: handler.Baht(200000), LostToGroup: handler.Baht(200000), CappedBy: handler.CapGroup},
+		{AllowanceType: "thai-esg", Requested: handler.Baht(400000), Deductible: handler.Baht(300000), CappedBy: handler.CapIncomePercent},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+}
+
+func TestInsuranceAllowances(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+	}
+
+	got := ApplyAllowances(data, handler.Baht(600000), 0, []handler.AllowancesArr{
+		{AllowanceType: "health-insurance", Amount: handler.Baht(30000)},
+		{AllowanceType: "life-insurance", Amount: handler.Baht(90000)},
+		{AllowanceType: "social-security", Amount: handler.Baht(9000)},
+		{AllowanceType: "home-loan-interest", Amount: handler.Baht(120000)},
+	})
+
+	want := []AllowanceResult{
+		{AllowanceType: "life-insurance", Requested: handler.Baht(90000), Deductible: handler.Baht(90000)},
+		{AllowanceType: "health-insurance", Requested: handler.Baht(30000), Deductible: handler.Baht(10000), LostToGroup: handler.Baht(15000), CappedBy: handler.CapGroup},
+		{AllowanceType: "social-security", Requested: handler.Baht(9000), Deductible: handler.Baht(9000)},
+		{AllowanceType: "home-loan-interest", Requested: handler.Baht(120000), Deductible: handler.Baht(100000), CappedBy: handler.CapFixed},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+}
+
+func TestDonationAllowances(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+	}
+	t.Run("should count qualifying donations double within 10% of net income", func(t *testing.T) {
+		got := ApplyAllowances(data, handler.Baht(1000000), 0, []handler.AllowancesArr{
+			{AllowanceType: "donation", Subtype: "education", Amount: handler.Baht(30000)},
+			{AllowanceType: "donation", Amount: handler.Baht(50000)},
+			{AllowanceType: "donation", Subtype: "political", Amount: handler.Baht(15000)},
+		})
+
+		want := []AllowanceResult{
+			{AllowanceType: "donation", Subtype: "political", Requested: handler.Baht(15000), Deductible: handler.Baht(10000), CappedBy: handler.CapFixed},
+			{AllowanceType: "donation", Subtype: "education", Requested: handler.Baht(30000), Deductible: handler.Baht(60000)},
+			{AllowanceType: "donation", Requested: handler.Baht(50000), Deductible: handler.Baht(33000), LostToGroup: handler.Baht(17000), CappedBy: handler.CapGroup},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+	t.Run("should reject unknown subtype", func(t *testing.T) {
+		got := ValidateAllowances(data, []handler.AllowancesArr{
+			{AllowanceType: "donation", Subtype: "temple", Amount: handler.Baht(100)},
+		})
+
+		want := []handler.ValidationErr{{Index: 0, Field: "subtype", Reason: `unsupported subtype "temple" of donation`}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+}
+
+func TestAllowanceCalculate(t *testing.T) {
+	t.Run("should cap donation at 10% of net income", func(t *testing.T) {
+		data := database.DataStruct{
+			PersonalAllowance: handler.Baht(60000),
+			Allowances:        database.DefaultAllowanceRules(),
+			Groups:            database.DefaultAllowanceGroups(),
+		}
+		request := handler.RequestCalculation{
+			TotalIncome: handler.Baht(500000),
+			Allowances: []handler.AllowancesArr{
+				{AllowanceType: "k-receipt", Amount: handler.Baht(200000)},
+				{AllowanceType: "donation", Amount: handler.Baht(100000)},
+			},
+		}
+
+		got, _, _ := AllowanceCalculate(data, request, 0, 0, nil)
+
+		if got != handler.Baht(351000) {
+			t.Errorf("expected %v but got %v", handler.Baht(351000), got)
+		}
+	})
+}
+
+func TestValidateAllowances(t *testing.T) {
+	data := database.DataStruct{Allowances: database.DefaultAllowanceRules()}
+	t.Run("should accept repeated supported types", func(t *testing.T) {
+		got := ValidateAllowances(data, []handler.AllowancesArr{
+			{AllowanceType: "donation", Amount: handler.Baht(100)},
+			{AllowanceType: "donation", Amount: handler.Baht(200)},
+		})
+
+		if len(got) != 0 {
+			t.Errorf("expected no errors but got %v", got)
+		}
+	})
+	t.Run("should report every offending index", func(t *testing.T) {
+		got := ValidateAllowances(data, []handler.AllowancesArr{
+			{AllowanceType: "donation", Amount: handler.Baht(100)},
+			{AllowanceType: "donations", Amount: handler.Baht(100)},
+			{AllowanceType: "k-receipt", Amount: handler.Baht(-1)},
+		})
+
+		want := []handler.ValidationErr{
+			{Index: 1, Field: "allowanceType", Reason: `unsupported allowanceType "donations"`},
+			{Index: 2, Field: "amount", Reason: "amount must not be negative"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+}
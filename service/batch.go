@@ -0,0 +1,318 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+// BatchStore keeps batch jobs and their results. database.BatchStore
+// implements it on Postgres.
+type BatchStore interface {
+	Create(mode string, file []byte) (int64, error)
+	Get(id int64) (handler.Batch, error)
+	File(id int64) ([]byte, error)
+	Requeue(stale time.Duration) error
+	Claim() (handler.Batch, bool, error)
+	Beat(batch handler.Batch) error
+	Release(batch handler.Batch) error
+	Start(batch handler.Batch, totalRows int) error
+	Save(batch handler.Batch, lines []handler.CSVLine, processedRows int) error
+	Finish(batch handler.Batch, status, message string) error
+	Results(id, after int64, limit int) ([]handler.CSVLine, int64, error)
+}
+
+// Paging of batch results.
+const (
+	DefaultBatchPage = 100
+	MaxBatchPage     = 1000
+)
+
+// Batches runs CSV uploads as background jobs. Workers jobs run at the
+// same time, each calculating Limits.Workers rows at a time, and results
+// are stored every ChunkRows results or so. A running job beats every Poll,
+// and one that has not for Stale is taken to have lost its worker and is
+// queued again, so several instances can share the store.
+type Batches struct {
+	Store     BatchStore
+	Load      database.Loader
+	Limits    CsvLimits
+	Workers   int
+	ChunkRows int
+	Poll      time.Duration
+	Stale     time.Duration
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewBatches(store BatchStore, load database.Loader, limits CsvLimits) *Batches {
+	return &Batches{Store: store, Load: load, Limits: limits, Workers: 1, ChunkRows: 500, Poll: 5 * time.Second, Stale: time.Minute, wake: make(chan struct{}, 1)}
+}
+
+// Start requeues the stale jobs left by workers that stopped without
+// releasing them and starts the workers.
+func (b *Batches) Start(ctx context.Context) error {
+	if err := b.Store.Requeue(b.Stale); err != nil {
+		return err
+	}
+	ctx, b.cancel = context.WithCancel(ctx)
+	for range max(b.Workers, 1) {
+		b.wg.Add(1)
+		go b.work(ctx)
+	}
+	return nil
+}
+
+// Stop interrupts the running jobs after their last stored results, puts
+// them back in the queue and waits for the workers.
+func (b *Batches) Stop() {
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.wg.Wait()
+}
+
+func (b *Batches) work(ctx context.Context) {
+	defer b.wg.Done()
+	for ctx.Err() == nil {
+		if err := b.Store.Requeue(b.Stale); err != nil {
+			log.Printf("Requeue batches failed: %v", err)
+		}
+		batch, ok, err := b.Store.Claim()
+		if err != nil {
+			log.Printf("Claim batch failed: %v", err)
+		}
+		if ok {
+			err = b.Run(ctx, batch)
+			if err == nil || errors.Is(err, context.Canceled) {
+				continue
+			}
+			log.Printf("Batch %d failed: %v", batch.ID, err)
+		}
+		// Wait after a failure too, so a database that is down is not
+		// retried in a busy loop.
+		select {
+		case <-ctx.Done():
+		case <-b.wake:
+		case <-time.After(b.Poll):
+		}
+	}
+}
+
+// Run calculates a claimed batch after the rows it already stored. A job
+// the file fails is finished as failed; the returned error is only for
+// storage failures, including rules that fail to load, and cancellation,
+// which put the job back in the queue to be resumed after its stored rows.
+// Run stops when the job cannot beat, and leaves a job another worker took
+// over to that worker.
+func (b *Batches) Run(ctx context.Context, batch handler.Batch) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go b.beat(ctx, cancel, batch)
+	err := b.run(ctx, batch)
+	if err != nil && !errors.Is(err, database.ErrBatchLost) {
+		if releaseErr := b.Store.Release(batch); releaseErr != nil {
+			return errors.Join(err, releaseErr)
+		}
+	}
+	return err
+}
+
+// beat beats batch every Poll until ctx is done, and cancels ctx with the
+// error of the first beat that fails.
+func (b *Batches) beat(ctx context.Context, cancel context.CancelCauseFunc, batch handler.Batch) {
+	ticker := time.NewTicker(b.Poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.Store.Beat(batch); err != nil {
+				cancel(err)
+				return
+			}
+		}
+	}
+}
+
+func (b *Batches) run(ctx context.Context, batch handler.Batch) error {
+	file, err := b.Store.File(batch.ID)
+	if err != nil {
+		return err
+	}
+	plan, err := CsvScan(bytes.NewReader(file), b.Load, b.Limits.MaxRows)
+	// Only the file fails the job for good; rules that fail to load are
+	// retried like any storage failure.
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) || errors.Is(err, ErrTooManyRows) {
+		return b.Store.Finish(batch, handler.BatchFailed, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if err := b.Store.Start(batch, plan.Rows); err != nil {
+		return err
+	}
+	if plan.Rejected(batch.Mode) {
+		if batch.ProcessedRows < plan.Rows {
+			lines := make([]handler.CSVLine, len(plan.Errors))
+			for i := range plan.Errors {
+				lines[i] = handler.CSVLine{Error: &plan.Errors[i]}
+			}
+			if err := b.Store.Save(batch, lines, plan.Rows); err != nil {
+				return err
+			}
+		}
+		return b.Store.Finish(batch, handler.BatchFailed, "invalid rows")
+	}
+
+	var chunk []handler.CSVLine
+	var saveErr error
+	last, rows := 0, batch.ProcessedRows
+	flush := func() error {
+		if len(chunk) > 0 {
+			saveErr = b.Store.Save(batch, chunk, rows)
+			chunk = chunk[:0]
+		}
+		return saveErr
+	}
+	err = plan.StreamFrom(bytes.NewReader(file), b.Limits.Workers, batch.ProcessedRows, func(l handler.CSVLine) error {
+		if err := context.Cause(ctx); err != nil {
+			return err
+		}
+		// Store whole rows only, so that a resumed job starts on a row.
+		if line := l.Line(); line != last {
+			if len(chunk) >= b.ChunkRows {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			last, rows = line, rows+1
+		}
+		chunk = append(chunk, l)
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if ctx.Err() != nil || saveErr != nil {
+		return err
+	}
+	if err != nil {
+		return b.Store.Finish(batch, handler.BatchFailed, err.Error())
+	}
+	return b.Store.Finish(batch, handler.BatchDone, "")
+}
+
+func (b *Batches) Submit(c echo.Context) error {
+	// The file comes first, since reading any form value reads the body.
+	file, ok, err := TaxFile(c, b.Limits.MaxBytes)
+	if !ok {
+		return err
+	}
+	mode := c.FormValue("mode")
+	if mode == "" {
+		mode = ModeAllOrNothing
+	}
+	if mode != ModeAllOrNothing && mode != ModeBestEffort {
+		return c.JSON(http.StatusBadRequest, Err{Message: "Invalid mode"})
+	}
+	src, err := file.Open()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: "taxFile(fileOpen) error"})
+	}
+	defer src.Close()
+	content, err := io.ReadAll(src)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: "taxFile(ReadAll) error"})
+	}
+	// Reject what is not CSV at all now; rows are checked by the job.
+	if _, err := csv.NewReader(bytes.NewReader(content)).Read(); err != nil && err != io.EOF {
+		return c.JSON(http.StatusBadRequest, Err{Message: "taxFile(Read) error: " + err.Error()})
+	}
+	id, err := b.Store.Create(mode, content)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	batch, err := b.Store.Get(id)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	return c.JSON(http.StatusAccepted, batch)
+}
+
+func (b *Batches) Status(c echo.Context) error {
+	batch, ok, err := b.batch(c)
+	if !ok {
+		return err
+	}
+	return c.JSON(http.StatusOK, batch)
+}
+
+// Results pages through the results of a batch in file order, ?limit= at a
+// time from the cursor ?after=. Stored results never change, so a running
+// batch can be paged as it goes.
+func (b *Batches) Results(c echo.Context) error {
+	batch, ok, err := b.batch(c)
+	if !ok {
+		return err
+	}
+	var after int64
+	if param := c.QueryParam("after"); param != "" {
+		if after, err = strconv.ParseInt(param, 10, 64); err != nil || after < 0 {
+			return c.JSON(http.StatusBadRequest, Err{Message: "invalid after: " + param})
+		}
+	}
+	limit := DefaultBatchPage
+	if param := c.QueryParam("limit"); param != "" {
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 || limit > MaxBatchPage {
+			return c.JSON(http.StatusBadRequest, Err{Message: fmt.Sprintf("limit must be between 1 and %d", MaxBatchPage)})
+		}
+	}
+	lines, cursor, err := b.Store.Results(batch.ID, after, limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	response := handler.ResponseBatchResults{Results: lines}
+	if len(lines) == limit {
+		response.Next = cursor
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// batch loads the batch named by the :id path parameter. Otherwise it
+// answers 400 for an id that is not a number or 404 for an unknown batch,
+// and returns ok false with the error of answering.
+func (b *Batches) batch(c echo.Context) (batch handler.Batch, ok bool, err error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return batch, false, c.JSON(http.StatusBadRequest, Err{Message: "invalid batch id: " + c.Param("id")})
+	}
+	batch, err = b.Store.Get(id)
+	if errors.Is(err, database.ErrUnknownBatch) {
+		return batch, false, c.JSON(http.StatusNotFound, Err{Message: err.Error()})
+	}
+	if err != nil {
+		return batch, false, c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	return batch, true, nil
+}
@@ -0,0 +1,305 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+// memBatchStore keeps batches in memory for tests. Like the Postgres
+// store it only updates a batch running under the claim of the caller.
+type memBatchStore struct {
+	mu      sync.Mutex
+	batches map[int64]*handler.Batch
+	files   map[int64][]byte
+	results map[int64][]handler.CSVLine
+	saveErr error
+}
+
+func newMemBatchStore() *memBatchStore {
+	return &memBatchStore{batches: map[int64]*handler.Batch{}, files: map[int64][]byte{}, results: map[int64][]handler.CSVLine{}}
+}
+
+func (s *memBatchStore) Create(mode string, file []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := int64(len(s.batches) + 1)
+	s.batches[id] = &handler.Batch{ID: id, Status: handler.BatchQueued, Mode: mode}
+	s.files[id] = file
+	return id, nil
+}
+
+func (s *memBatchStore) Get(id int64) (handler.Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[id]
+	if !ok {
+		return handler.Batch{}, fmt.Errorf("%w: %d", database.ErrUnknownBatch, id)
+	}
+	return *b, nil
+}
+
+func (s *memBatchStore) File(id int64) ([]byte, error) { return s.files[id], nil }
+
+// Requeue has no clock, so it takes every running batch to be stale.
+func (s *memBatchStore) Requeue(stale time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.batches {
+		if b.Status == handler.BatchRunning {
+			b.Status = handler.BatchQueued
+		}
+	}
+	return nil
+}
+
+func (s *memBatchStore) Claim() (handler.Batch, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := int64(1); id <= int64(len(s.batches)); id++ {
+		if b := s.batches[id]; b.Status == handler.BatchQueued {
+			b.Status = handler.BatchRunning
+			b.Claim++
+			return *b, true, nil
+		}
+	}
+	return handler.Batch{}, false, nil
+}
+
+// update runs f on the stored batch while it is running under the claim
+// of batch.
+func (s *memBatchStore) update(batch handler.Batch, f func(b *handler.Batch)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.batches[batch.ID]
+	if b.Status != handler.BatchRunning || b.Claim != batch.Claim {
+		return fmt.Errorf("%w: %d", database.ErrBatchLost, batch.ID)
+	}
+	f(b)
+	return nil
+}
+
+func (s *memBatchStore) Beat(batch handler.Batch) error {
+	return s.update(batch, func(*handler.Batch) {})
+}
+
+func (s *memBatchStore) Release(batch handler.Batch) error {
+	return s.update(batch, func(b *handler.Batch) { b.Status = handler.BatchQueued })
+}
+
+func (s *memBatchStore) Start(batch handler.Batch, totalRows int) error {
+	return s.update(batch, func(b *handler.Batch) { b.TotalRows = totalRows })
+}
+
+func (s *memBatchStore) Save(batch handler.Batch, lines []handler.CSVLine, processedRows int) error {
+	if s.saveErr != nil {
+		return s.saveErr
+	}
+	return s.update(batch, func(b *handler.Batch) {
+		s.results[b.ID] = append(s.results[b.ID], lines...)
+		b.ProcessedRows = processedRows
+	})
+}
+
+func (s *memBatchStore) Finish(batch handler.Batch, status, message string) error {
+	return s.update(batch, func(b *handler.Batch) { b.Status, b.Error = status, message })
+}
+
+func (s *memBatchStore) Results(id, after int64, limit int) ([]handler.CSVLine, int64, error) {
+	lines := s.results[id][min(int(after), len(s.results[id])):]
+	lines = lines[:min(limit, len(lines))]
+	return lines, after + int64(len(lines)), nil
+}
+
+func TestBatchesRun(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	var file strings.Builder
+	file.WriteString("totalIncome,wht\n")
+	for i := range 10 {
+		fmt.Fprintf(&file, "%d,0\n", 500000+i)
+	}
+	file.WriteString("500000,600000\n")
+	newBatches := func(mode string) (*Batches, *memBatchStore, handler.Batch) {
+		store := newMemBatchStore()
+		store.Create(mode, []byte(file.String()))
+		batches := NewBatches(store, loadData(data), DefaultCsvLimits())
+		batches.ChunkRows = 3
+		batch, _, _ := store.Claim()
+		return batches, store, batch
+	}
+	t.Run("should store every row in chunks and finish", func(t *testing.T) {
+		batches, store, batch := newBatches(ModeBestEffort)
+
+		err := batches.Run(context.Background(), batch)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		got := store.batches[batch.ID]
+		if got.Status != handler.BatchDone || got.TotalRows != 11 || got.ProcessedRows != 11 || len(store.results[batch.ID]) != 11 {
+			t.Errorf("expected 11 rows done but got %+v with %v results", got, len(store.results[batch.ID]))
+		}
+		if last := store.results[batch.ID][10]; last.Error == nil || last.Error.Line != 12 {
+			t.Errorf("expected an error on line 12 but got %+v", last)
+		}
+	})
+	t.Run("should resume after the stored rows", func(t *testing.T) {
+		batches, store, batch := newBatches(ModeBestEffort)
+		store.Save(batch, []handler.CSVLine{{Tax: &handler.ResponseCSV{Line: 2}}, {Tax: &handler.ResponseCSV{Line: 3}}}, 2)
+		batch.ProcessedRows = 2
+
+		err := batches.Run(context.Background(), batch)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		results := store.results[batch.ID]
+		if len(results) != 11 || results[2].Line() != 4 {
+			t.Errorf("expected 11 results continuing at line 4 but got %v", len(results))
+		}
+	})
+	t.Run("should fail on any invalid row in all-or-nothing mode", func(t *testing.T) {
+		batches, store, batch := newBatches(ModeAllOrNothing)
+
+		err := batches.Run(context.Background(), batch)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		got := store.batches[batch.ID]
+		if got.Status != handler.BatchFailed || len(store.results[batch.ID]) != 1 {
+			t.Errorf("expected a failed batch with one error but got %+v with %v", got, store.results[batch.ID])
+		}
+	})
+	t.Run("should queue the batch again when results cannot be stored", func(t *testing.T) {
+		batches, store, batch := newBatches(ModeBestEffort)
+		store.saveErr = errors.New("database down")
+
+		err := batches.Run(context.Background(), batch)
+
+		if err == nil || store.batches[batch.ID].Status != handler.BatchQueued {
+			t.Errorf("expected a queued batch and an error but got %v and %v", store.batches[batch.ID].Status, err)
+		}
+	})
+	t.Run("should queue the batch again when the rules cannot be loaded", func(t *testing.T) {
+		batches, store, batch := newBatches(ModeBestEffort)
+		batches.Load = func(int) (database.DataStruct, error) { return database.DataStruct{}, errors.New("connection reset") }
+
+		err := batches.Run(context.Background(), batch)
+
+		if err == nil || store.batches[batch.ID].Status != handler.BatchQueued {
+			t.Errorf("expected a queued batch and an error but got %v and %v", store.batches[batch.ID].Status, err)
+		}
+	})
+	t.Run("should queue the batch again when stopped", func(t *testing.T) {
+		batches, store, batch := newBatches(ModeBestEffort)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := batches.Run(ctx, batch)
+
+		if !errors.Is(err, context.Canceled) || store.batches[batch.ID].Status != handler.BatchQueued {
+			t.Errorf("expected a queued batch after cancellation but got %v and %v", store.batches[batch.ID].Status, err)
+		}
+	})
+	t.Run("should let only the latest claim of a requeued batch store results", func(t *testing.T) {
+		batches, store, stalled := newBatches(ModeBestEffort)
+		store.Requeue(0)
+		claims := make(chan handler.Batch, 2)
+		var wg sync.WaitGroup
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if batch, ok, _ := store.Claim(); ok {
+					claims <- batch
+				}
+			}()
+		}
+		wg.Wait()
+		close(claims)
+
+		stalledErr := batches.Run(context.Background(), stalled)
+		var errs []error
+		for batch := range claims {
+			errs = append(errs, batches.Run(context.Background(), batch))
+		}
+
+		if !errors.Is(stalledErr, database.ErrBatchLost) {
+			t.Errorf("expected ErrBatchLost for the stalled worker but got %v", stalledErr)
+		}
+		if len(errs) != 1 || errs[0] != nil {
+			t.Errorf("expected one claim to run without error but got %v", errs)
+		}
+		got := store.batches[stalled.ID]
+		if got.Status != handler.BatchDone || got.ProcessedRows != 11 || len(store.results[stalled.ID]) != 11 {
+			t.Errorf("expected 11 rows stored once but got %+v with %v results", got, len(store.results[stalled.ID]))
+		}
+	})
+	t.Run("should stop beating a batch another worker took over", func(t *testing.T) {
+		batches, store, batch := newBatches(ModeBestEffort)
+		batches.Poll = time.Millisecond
+		ctx, cancel := context.WithCancelCause(context.Background())
+		store.Requeue(0)
+		store.Claim()
+
+		batches.beat(ctx, cancel, batch)
+
+		if err := context.Cause(ctx); !errors.Is(err, database.ErrBatchLost) {
+			t.Errorf("expected ErrBatchLost but got %v", err)
+		}
+	})
+}
+
+func TestBatchesHandlers(t *testing.T) {
+	store := newMemBatchStore()
+	store.Create(ModeBestEffort, []byte("totalIncome\n500000\n"))
+	store.results[1] = []handler.CSVLine{{Tax: &handler.ResponseCSV{Line: 2}}, {Tax: &handler.ResponseCSV{Line: 3}}}
+	batches := NewBatches(store, nil, DefaultCsvLimits())
+	get := func(path, id string, h echo.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		res := httptest.NewRecorder()
+		c := echo.New().NewContext(req, res)
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+		h(c)
+		return res
+	}
+	t.Run("should return status 404 for an unknown batch", func(t *testing.T) {
+		res := get("/", "9", batches.Status)
+
+		if res.Result().StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %v but got status %v", http.StatusNotFound, res.Result().StatusCode)
+		}
+	})
+	t.Run("should page through the results", func(t *testing.T) {
+		res := get("/?limit=1", "1", batches.Results)
+
+		want := `{"results":[{"tax":{"line":2,"totalIncome":0,"tax":0}}],"next":1}` + "\n"
+		if res.Body.String() != want {
+			t.Errorf("expected %q but got %q", want, res.Body.String())
+		}
+	})
+	t.Run("should return status 400 for a limit above the maximum", func(t *testing.T) {
+		res := get("/?limit=5000", "1", batches.Results)
+
+		if res.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %v but got status %v", http.StatusBadRequest, res.Result().StatusCode)
+		}
+	})
+}
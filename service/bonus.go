@@ -0,0 +1,72 @@
+package service
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+func Bonus(c echo.Context, load database.Loader) error {
+	var request handler.RequestBonus
+	if err := c.Bind(&request); err != nil {
+		return err
+	}
+	if request.Bonus < 0 {
+		return c.JSON(http.StatusBadRequest, Err{Message: "Invalid bonus"})
+	}
+	if request.Category == "" {
+		request.Category = "40(1)"
+	}
+	if !slices.Contains(handler.IncomeCategories, request.Category) {
+		return c.JSON(http.StatusBadRequest, Err{Message: "Invalid category"})
+	}
+	data, ok, err := PrepareRequest(c, load, &request.RequestCalculation)
+	if !ok {
+		return err
+	}
+	response, err := BonusCalculate(data, request)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// WithBonus returns a copy of a validated request with the bonus added.
+func WithBonus(request handler.RequestBonus) handler.RequestCalculation {
+	with := request.RequestCalculation
+	with.TotalIncome += request.Bonus
+	if len(with.Incomes) > 0 {
+		with.Incomes = append(slices.Clone(with.Incomes), handler.IncomeArr{Payer: "bonus", Category: request.Category, Amount: request.Bonus})
+	}
+	return with
+}
+
+// BonusCalculate runs the calculation of a validated request with and
+// without its bonus on the same data. TaxLevel lists the levels the taxable
+// income added by the bonus falls into, with the tax the bonus adds in each.
+func BonusCalculate(data database.DataStruct, request handler.RequestBonus) (handler.ResponseBonus, error) {
+	response := handler.ResponseBonus{Bonus: request.Bonus, TaxLevel: []handler.TaxLevelArr{}}
+	var err error
+	if response.Without, err = Compute(data, request.RequestCalculation, nil); err != nil {
+		return response, err
+	}
+	if response.With, err = Compute(data, WithBonus(request), nil); err != nil {
+		return response, err
+	}
+	response.IncrementalTax = TaxDue(response.With) - TaxDue(response.Without)
+	response.NetBonus = request.Bonus - response.IncrementalTax
+	response.EffectiveRate = EffectiveRate(response.IncrementalTax, request.Bonus)
+	without, with := response.Without.TaxableIncome, response.With.TaxableIncome
+	for i, level := range CreateLevels(data.Brackets) {
+		if with > without && with > level.MinAmount && without < level.MaxAmount {
+			response.TaxLevel = append(response.TaxLevel, handler.TaxLevelArr{
+				Level: level.LevelString,
+				Tax:   response.With.TaxLevel[i].Tax - response.Without.TaxLevel[i].Tax,
+			})
+		}
+	}
+	return response, nil
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+func TestBonusCalculate(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+		Expenses:          database.DefaultExpenseRules(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	t.Run("should return the tax a bonus adds per level", func(t *testing.T) {
+		request := handler.RequestBonus{
+			RequestCalculation: handler.RequestCalculation{TotalIncome: handler.Baht(500000)},
+			Bonus:              handler.Baht(100000),
+		}
+
+		got, err := BonusCalculate(data, request)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got.IncrementalTax != handler.Baht(12000) || got.NetBonus != handler.Baht(88000) || got.EffectiveRate != 0.12 {
+			t.Errorf("expected 12000 tax and 88000 net at 0.12 but got %v, %v at %v", got.IncrementalTax, got.NetBonus, got.EffectiveRate)
+		}
+		want := []handler.TaxLevelArr{
+			{Level: "150,001 - 500,000", Tax: handler.Baht(6000)},
+			{Level: "500,001 - 1,000,000", Tax: handler.Baht(6000)},
+		}
+		if !reflect.DeepEqual(got.TaxLevel, want) {
+			t.Errorf("expected %v but got %v", want, got.TaxLevel)
+		}
+	})
+	t.Run("should add the bonus as an income when incomes are sent", func(t *testing.T) {
+		request := handler.RequestBonus{
+			RequestCalculation: handler.RequestCalculation{
+				TotalIncome: handler.Baht(600000),
+				Incomes:     []handler.IncomeArr{{Category: "40(1)", Amount: handler.Baht(600000)}},
+			},
+			Bonus:    handler.Baht(100000),
+			Category: "40(1)",
+		}
+
+		got, err := BonusCalculate(data, request)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got.With.ExpenseDeduction != handler.Baht(100000) || got.IncrementalTax != handler.Baht(12000) {
+			t.Errorf("expected expenses capped at 100000 and 12000 tax but got %v and %v", got.With.ExpenseDeduction, got.IncrementalTax)
+		}
+	})
+	t.Run("should list no level for a bonus that adds no taxable income", func(t *testing.T) {
+		request := handler.RequestBonus{RequestCalculation: handler.RequestCalculation{TotalIncome: handler.Baht(500000)}}
+
+		got, err := BonusCalculate(data, request)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got.IncrementalTax != 0 || len(got.TaxLevel) != 0 {
+			t.Errorf("expected no tax and no level but got %v and %v", got.IncrementalTax, got.TaxLevel)
+		}
+	})
+}
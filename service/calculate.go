@@ -1,8 +1,12 @@
 package service
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/Bgarnn/assessment-tax/database"
 	handler "github.com/Bgarnn/assessment-tax/struct"
@@ -12,43 +16,196 @@ import (
 type Level struct {
 	Level             int
 	LevelString       string
-	MinAmount         float64
-	MaxAmount         float64
+	MinAmount         handler.Money
+	MaxAmount         handler.Money
 	TaxRatePercentage float64
 }
 
-func CreateLevels() []Level {
-	return []Level{
-		{Level: 1, LevelString: "0 - 150,000", MinAmount: 0.0, MaxAmount: 150000, TaxRatePercentage: 0.00},
-		{Level: 2, LevelString: "150,001 - 500,000", MinAmount: 150001.00, MaxAmount: 500000.00, TaxRatePercentage: 0.10},
-		{Level: 3, LevelString: "500,001 - 1,000,000", MinAmount: 500001.00, MaxAmount: 1000000.00, TaxRatePercentage: 0.15},
-		{Level: 4, LevelString: "1,000,001 - 2,000,000", MinAmount: 1000001.00, MaxAmount: 2000000.00, TaxRatePercentage: 0.20},
-		{Level: 5, LevelString: "2,000,001 ขึ้นไป", MinAmount: 2000001.00, MaxAmount: math.MaxFloat64, TaxRatePercentage: 0.35},
+func CreateLevels(brackets []handler.Bracket) []Level {
+	levels := make([]Level, 0, len(brackets))
+	for i, b := range brackets {
+		maxAmount := handler.MaxMoney
+		if b.MaxAmount != nil {
+			maxAmount = *b.MaxAmount
+		}
+		levels = append(levels, Level{
+			Level:             i + 1,
+			LevelString:       LevelLabel(b.MinAmount, b.MaxAmount),
+			MinAmount:         b.MinAmount,
+			MaxAmount:         maxAmount,
+			TaxRatePercentage: b.Rate,
+		})
+	}
+	return levels
+}
+
+// LevelLabel names a level in the customary whole-baht form, so the level
+// above 150,000 up to 500,000 reads "150,001 - 500,000".
+func LevelLabel(minAmount handler.Money, maxAmount *handler.Money) string {
+	if minAmount > 0 {
+		minAmount += handler.Baht(1)
+	}
+	if maxAmount == nil {
+		return FormatAmount(minAmount) + " ขึ้นไป"
+	}
+	return FormatAmount(minAmount) + " - " + FormatAmount(*maxAmount)
+}
+
+// FormatAmount renders a baht amount with thousands separators, e.g. 1,000,001.
+func FormatAmount(amount handler.Money) string {
+	digits := amount.String()
+	sign := ""
+	if digits[0] == '-' {
+		sign, digits = "-", digits[1:]
+	}
+	digits, fraction, found := strings.Cut(digits, ".")
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
 	}
+	if found {
+		digits += "." + fraction
+	}
+	return sign + digits
 }
 
-func Calculate(c echo.Context, data database.DataStruct) error {
+func Calculate(c echo.Context, load database.Loader) error {
 	var request handler.RequestCalculation
 	if err := c.Bind(&request); err != nil {
 		return err
 	}
-	request.Wht = ValidateWht(request.Wht, request.TotalIncome)
-	if request.Wht == -1 {
-		return c.JSON(http.StatusBadRequest, Err{Message: "Invalid wht"})
+	data, ok, err := PrepareRequest(c, load, &request)
+	if !ok {
+		return err
 	}
-	taxableIncome, err := AllowanceCalculate(data, request)
+	var trace *Trace
+	if explain, _ := strconv.ParseBool(c.QueryParam("explain")); explain {
+		trace = &Trace{}
+	}
+	response, err := Compute(data, request, trace)
 	if err != nil {
 		return err
 	}
-	taxAmount, taxLevels := TaxLevelCalculate(taxableIncome)
-	var taxRefund float64
-	taxRefund, taxAmount = WhtCalculate(request.Wht, taxAmount)
-	response := handler.ResponseCalculation{TaxRefund: taxRefund, Tax: taxAmount, TaxLevel: taxLevels}
 	return c.JSON(http.StatusOK, response)
 }
 
-func WhtCalculate(wht, taxAmount float64) (float64, float64) {
-	var taxRefund float64
+// PrepareRequest defaults the tax year of a bound request, loads its rules
+// and validates it. When ok is false the error response has already been
+// sent and err is what the handler should return.
+func PrepareRequest(c echo.Context, load database.Loader, request *handler.RequestCalculation) (data database.DataStruct, ok bool, err error) {
+	request.TaxYear = database.TaxYearOrDefault(request.TaxYear)
+	data, err = load(request.TaxYear)
+	if err != nil {
+		return data, false, LoadError(c, request.TaxYear, err)
+	}
+	if invalid := ValidateRequest(data, request); invalid != nil {
+		return data, false, c.JSON(http.StatusBadRequest, invalid)
+	}
+	return data, true, nil
+}
+
+// ValidateRequest resolves the incomes of a request and checks every field
+// against the rules of data. It returns the body of the 400 response, or
+// nil when the request is valid.
+func ValidateRequest(data database.DataStruct, request *handler.RequestCalculation) any {
+	if errs := ValidateIncomes(request.Incomes); len(errs) > 0 {
+		return handler.ResponseValidation{Message: "Invalid incomes", Errors: errs}
+	}
+	if err := ResolveIncomes(request); err != nil {
+		return Err{Message: err.Error()}
+	}
+	if ValidateWht(request.Wht, request.TotalIncome) == -1 {
+		return Err{Message: "Invalid wht"}
+	}
+	if errs := ValidateAllowances(data, request.Allowances); len(errs) > 0 {
+		return handler.ResponseValidation{Message: "Invalid allowances", Errors: errs}
+	}
+	if errs := ValidateDependents(request.Dependents, request.TaxYear); len(errs) > 0 {
+		return handler.ResponseValidation{Message: "Invalid dependents", Errors: errs}
+	}
+	return nil
+}
+
+// Compute runs the calculation for a validated request. When trace is not
+// nil every intermediate step is recorded and returned in the response.
+func Compute(data database.DataStruct, request handler.RequestCalculation, trace *Trace) (handler.ResponseCalculation, error) {
+	for _, income := range request.Incomes {
+		trace.Add(handler.TraceStep{Step: "income", Name: income.Payer, Amount: income.Amount, Note: fmt.Sprintf("category %s, wht %s", income.Category, FormatAmount(income.Wht))})
+	}
+	expense := ExpenseCalculate(data, request.Incomes, trace)
+	dependents, family := DependentCalculate(data, request, trace)
+	taxableIncome, allowances, err := AllowanceCalculate(data, request, expense, family, trace)
+	if err != nil {
+		return handler.ResponseCalculation{}, err
+	}
+	levels := CreateLevels(data.Brackets)
+	progressiveTax, taxLevels := TaxLevelCalculate(taxableIncome, levels, trace)
+	trace.Add(handler.TraceStep{Step: "progressiveTax", Amount: progressiveTax, Note: "sum of tax per level"})
+	grossIncomeTax := GrossIncomeTaxCalculate(data.MinimumTax, request.Incomes, trace)
+	taxMethod, taxAmount := TaxMethod(progressiveTax, grossIncomeTax)
+	trace.Add(handler.TraceStep{Step: "tax", Name: taxMethod, Amount: taxAmount, Note: "higher of progressive and gross income tax"})
+	taxRefund, taxPayable := WhtCalculate(request.Wht, taxAmount)
+	trace.Add(handler.TraceStep{Step: "wht", Amount: request.Wht, Note: "withholding tax already paid"})
+	if taxRefund > 0 {
+		trace.Add(handler.TraceStep{Step: "taxRefund", Amount: taxRefund, Note: "withholding exceeds tax, the difference is refunded"})
+	} else {
+		trace.Add(handler.TraceStep{Step: "taxPayable", Amount: taxPayable, Note: "tax less withholding, no refund"})
+	}
+	response := handler.ResponseCalculation{
+		TaxRefund:        taxRefund,
+		Tax:              taxPayable,
+		TaxMethod:        taxMethod,
+		ProgressiveTax:   progressiveTax,
+		GrossIncomeTax:   grossIncomeTax,
+		ExpenseDeduction: expense,
+		TaxableIncome:    taxableIncome,
+		EffectiveRate:    EffectiveRate(taxAmount, request.TotalIncome),
+		Dependents:       dependents,
+		TaxLevel:         taxLevels,
+	}
+	if level := GetTaxLevel(taxableIncome, levels); level != -1 {
+		response.MarginalRate = levels[level].TaxRatePercentage
+		response.CurrentBracket = levels[level].LevelString
+	}
+	for _, a := range allowances {
+		if a.AllowanceType == "donation" {
+			response.DonationDeduction += a.Deductible
+		}
+		response.Allowances = append(response.Allowances, handler.AllowanceDeduction{
+			AllowanceType: a.AllowanceType,
+			Subtype:       a.Subtype,
+			Requested:     a.Requested,
+			Deductible:    a.Deductible,
+			LostToGroup:   a.LostToGroup,
+			CappedBy:      a.CappedBy,
+		})
+	}
+	if trace != nil {
+		response.Trace = trace.Steps
+	}
+	return response, nil
+}
+
+func LoadError(c echo.Context, taxYear int, err error) error {
+	if errors.Is(err, database.ErrUnknownTaxYear) {
+		return c.JSON(http.StatusBadRequest, Err{Message: fmt.Sprintf("Unsupported taxYear: %d", taxYear)})
+	}
+	return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+}
+
+// EffectiveRate is the tax as a share of the total income, before the
+// withholding is offset, rounded to four decimal places.
+func EffectiveRate(tax, totalIncome handler.Money) float64 {
+	if totalIncome <= 0 {
+		return 0
+	}
+	return math.Round(float64(tax)/float64(totalIncome)*10000) / 10000
+}
+
+// WhtCalculate offsets the tax by the withholding already paid. Both are
+// whole satang, so the tax payable and the refund are exact and need no
+// further rounding.
+func WhtCalculate(wht, taxAmount handler.Money) (handler.Money, handler.Money) {
+	var taxRefund handler.Money
 	taxAmount -= wht
 	if taxAmount < 0 {
 		taxRefund = (-1) * taxAmount
@@ -58,68 +215,73 @@ func WhtCalculate(wht, taxAmount float64) (float64, float64) {
 	return 0, taxAmount
 }
 
-func AllowanceCalculate(data database.DataStruct, request handler.RequestCalculation) (float64, error) {
-	var totalAllowanceAmount float64
-	DonationValidate(&request)
-	KReceiptValidate(data, &request)
-	for _, a := range request.Allowances {
-		totalAllowanceAmount += a.Amount
+// AllowanceCalculate returns the taxable income: total income less the
+// expense deduction, the family allowances, every other allowance and the
+// personal allowance, floored at zero.
+func AllowanceCalculate(data database.DataStruct, request handler.RequestCalculation, expense, family handler.Money, trace *Trace) (handler.Money, []AllowanceResult, error) {
+	totalAllowanceAmount := family
+	rules := map[string]handler.AllowanceRule{}
+	for _, rule := range data.Allowances {
+		rules[rule.Key()] = rule
+	}
+	allowances := ApplyAllowances(data, request.TotalIncome, expense+family, request.Allowances)
+	for _, a := range allowances {
+		totalAllowanceAmount += a.Deductible
+		key := handler.AllowanceRule{AllowanceType: a.AllowanceType, Subtype: a.Subtype}.Key()
+		trace.Add(handler.TraceStep{Step: "allowance", Name: key, Requested: traceMoney(a.Requested), Amount: a.Deductible, Note: capNote(rules[key], a)})
 	}
 	totalAllowanceAmount += data.PersonalAllowance
-	taxableIncome := request.TotalIncome - totalAllowanceAmount
-	return taxableIncome, nil
+	trace.Add(handler.TraceStep{Step: "personalAllowance", Amount: data.PersonalAllowance})
+	taxableIncome := max(request.TotalIncome-expense-totalAllowanceAmount, 0)
+	note := fmt.Sprintf("totalIncome %s less expenses %s and allowances %s", FormatAmount(request.TotalIncome), FormatAmount(expense), FormatAmount(totalAllowanceAmount))
+	if request.TotalIncome-expense < totalAllowanceAmount {
+		note += ", floored at 0"
+	}
+	trace.Add(handler.TraceStep{Step: "taxableIncome", Amount: taxableIncome, Note: note})
+	return taxableIncome, allowances, nil
 }
 
-func TaxLevelCalculate(taxableIncome float64) (float64, []handler.TaxLevelArr) {
+// TaxLevelCalculate returns the progressive tax and its split per level.
+// Each level taxes the part of the income above its MinAmount up to its
+// MaxAmount; because levels are contiguous the parts add up to exactly the
+// taxable income, which is floored at zero. Each level's tax drops
+// fractions of a satang (see handler.Money.MulRate) and the total is the
+// sum of the levels, so the two always agree.
+func TaxLevelCalculate(taxableIncome handler.Money, taxLevelDetail []Level, trace *Trace) (handler.Money, []handler.TaxLevelArr) {
 	var taxLevelsArr []handler.TaxLevelArr
-	var taxResultTotal float64
-	taxLevelDetail := CreateLevels()
-
-	levelOfTax := GetTaxLevel(taxableIncome, taxLevelDetail)
-	for i := levelOfTax; i >= 0; i-- {
-		totalIncomeThisLevel := min(taxableIncome, taxLevelDetail[i].MaxAmount) - taxLevelDetail[i].MinAmount + 1
-		taxResultThisLevel := totalIncomeThisLevel * taxLevelDetail[i].TaxRatePercentage
-		newTaxLevel := handler.TaxLevelArr{Level: taxLevelDetail[i].LevelString, Tax: taxResultThisLevel}
-		taxLevelsArr = append([]handler.TaxLevelArr{newTaxLevel}, taxLevelsArr...)
+	var taxResultTotal handler.Money
+	taxableIncome = max(taxableIncome, 0)
+
+	for _, level := range taxLevelDetail {
+		var totalIncomeThisLevel handler.Money
+		if taxableIncome > level.MinAmount {
+			totalIncomeThisLevel = min(taxableIncome, level.MaxAmount) - level.MinAmount
+		}
+		taxResultThisLevel := totalIncomeThisLevel.MulRate(level.TaxRatePercentage)
+		taxLevelsArr = append(taxLevelsArr, handler.TaxLevelArr{Level: level.LevelString, Tax: taxResultThisLevel})
+		trace.Add(handler.TraceStep{Step: "level", Name: level.LevelString, Amount: totalIncomeThisLevel, Rate: traceRate(level.TaxRatePercentage), Tax: traceMoney(taxResultThisLevel)})
 		taxResultTotal += taxResultThisLevel
-		taxableIncome -= totalIncomeThisLevel
-	}
-	for i := levelOfTax + 1; i <= 4; i++ {
-		taxLevelsArr = append(taxLevelsArr, handler.TaxLevelArr{Level: taxLevelDetail[i].LevelString, Tax: 0})
 	}
 	return taxResultTotal, taxLevelsArr
 }
 
-func GetTaxLevel(taxableIncome float64, levels []Level) int {
-	for _, level := range levels {
-		if taxableIncome >= level.MinAmount && taxableIncome <= level.MaxAmount {
-			return level.Level - 1
+// GetTaxLevel returns the index of the level that contains taxableIncome,
+// or -1 when it is negative. Zero belongs to the first level.
+func GetTaxLevel(taxableIncome handler.Money, levels []Level) int {
+	if taxableIncome < 0 {
+		return -1
+	}
+	for i, level := range levels {
+		if taxableIncome <= level.MaxAmount {
+			return i
 		}
 	}
-	return -1
+	return len(levels) - 1
 }
 
-func ValidateWht(amount, totalIncome float64) float64 {
+func ValidateWht(amount, totalIncome handler.Money) handler.Money {
 	if amount > totalIncome || amount < 0 {
 		return -1
 	}
 	return amount
 }
-
-func DonationValidate(request *handler.RequestCalculation) {
-	for i := range request.Allowances {
-		if request.Allowances[i].AllowanceType == "donation" && request.Allowances[i].Amount > 100000 {
-			request.Allowances[i].Amount = 100000
-		}
-	}
-}
-
-func KReceiptValidate(data database.DataStruct, request *handler.RequestCalculation) (float64, error) {
-	maxKReceipt := data.MaxKReceipt
-	for i := range request.Allowances {
-		if request.Allowances[i].AllowanceType == "k-receipt" && request.Allowances[i].Amount > maxKReceipt {
-			request.Allowances[i].Amount = maxKReceipt
-		}
-	}
-	return maxKReceipt, nil
-}
@@ -3,7 +3,7 @@ package service
 import (
 	"bytes"
 	"encoding/json"
-	"math"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -15,17 +15,17 @@ import (
 )
 
 var LevelDetail = []Level{
-	{Level: 1, LevelString: "0 - 150,000", MinAmount: 0.0, MaxAmount: 150000, TaxRatePercentage: 0.00},
-	{Level: 2, LevelString: "150,001 - 500,000", MinAmount: 150001.00, MaxAmount: 500000.00, TaxRatePercentage: 0.10},
-	{Level: 3, LevelString: "500,001 - 1,000,000", MinAmount: 500001.00, MaxAmount: 1000000.00, TaxRatePercentage: 0.15},
-	{Level: 4, LevelString: "1,000,001 - 2,000,000", MinAmount: 1000001.00, MaxAmount: 2000000.00, TaxRatePercentage: 0.20},
-	{Level: 5, LevelString: "2,000,001 ขึ้นไป", MinAmount: 2000001.00, MaxAmount: math.MaxFloat64, TaxRatePercentage: 0.35},
+	{Level: 1, LevelString: "0 - 150,000", MinAmount: handler.Baht(0), MaxAmount: handler.Baht(150000), TaxRatePercentage: 0.00},
+	{Level: 2, LevelString: "150,001 - 500,000", MinAmount: handler.Baht(150000), MaxAmount: handler.Baht(500000), TaxRatePercentage: 0.10},
+	{Level: 3, LevelString: "500,001 - 1,000,000", MinAmount: handler.Baht(500000), MaxAmount: handler.Baht(1000000), TaxRatePercentage: 0.15},
+	{Level: 4, LevelString: "1,000,001 - 2,000,000", MinAmount: handler.Baht(1000000), MaxAmount: handler.Baht(2000000), TaxRatePercentage: 0.20},
+	{Level: 5, LevelString: "2,000,001 ขึ้นไป", MinAmount: handler.Baht(2000000), MaxAmount: handler.MaxMoney, TaxRatePercentage: 0.35},
 }
 
 func TestCreateLevels(t *testing.T) {
 	expectedLevels := LevelDetail
 
-	actualLevels := CreateLevels()
+	actualLevels := CreateLevels(database.DefaultBrackets())
 
 	for i, expected := range expectedLevels {
 		actual := actualLevels[i]
@@ -39,13 +39,30 @@ func TestCreateLevels(t *testing.T) {
 	}
 }
 
+func TestFormatAmount(t *testing.T) {
+	t.Run("should add thousands separators", func(t *testing.T) {
+		got := FormatAmount(handler.Baht(2000001))
+
+		if got != "2,000,001" {
+			t.Errorf("expected %v but got %v", "2,000,001", got)
+		}
+	})
+	t.Run("should keep small amounts and fractions", func(t *testing.T) {
+		got := FormatAmount(handler.Money(15050))
+
+		if got != "150.5" {
+			t.Errorf("expected %v but got %v", "150.5", got)
+		}
+	})
+}
+
 func TestCalculate(t *testing.T) {
 	t.Run("should return 29000 with status 200", func(t *testing.T) {
 		body, err := json.Marshal(handler.RequestCalculation{
-			TotalIncome: 500000.0,
-			Wht:         0,
+			TotalIncome: handler.Baht(500000),
+			Wht:         handler.Baht(0),
 			Allowances: []handler.AllowancesArr{
-				{AllowanceType: "donation", Amount: 0.0},
+				{AllowanceType: "donation", Amount: handler.Baht(0)},
 			},
 		})
 		if err != nil {
@@ -57,23 +74,32 @@ func TestCalculate(t *testing.T) {
 		e := echo.New()
 		c := e.NewContext(req, res)
 		data := database.DataStruct{
-			PersonalAllowance: 60000.0,
-			MaxKReceipt:       50000.0,
+			PersonalAllowance: handler.Baht(60000),
+			Allowances:        database.DefaultAllowanceRules(),
+			Groups:            database.DefaultAllowanceGroups(),
+			Brackets:          database.DefaultBrackets(),
 		}
 
-		Calculate(c, data)
+		Calculate(c, loadData(data))
 
 		if res.Result().StatusCode != http.StatusOK {
 			t.Errorf("expected status %v but got status %v", http.StatusOK, res.Result().StatusCode)
 		}
 		want := handler.ResponseCalculation{
-			Tax: 29000.0,
+			Tax:            handler.Baht(29000),
+			TaxMethod:      handler.TaxMethodProgressive,
+			ProgressiveTax: handler.Baht(29000),
+			TaxableIncome:  handler.Baht(440000),
+			EffectiveRate:  0.058,
+			MarginalRate:   0.1,
+			CurrentBracket: "150,001 - 500,000",
+			Allowances:     []handler.AllowanceDeduction{{AllowanceType: "donation"}},
 			TaxLevel: []handler.TaxLevelArr{
-				{Level: "0 - 150,000", Tax: 0.00},
-				{Level: "150,001 - 500,000", Tax: 29000.00},
-				{Level: "500,001 - 1,000,000", Tax: 0.00},
-				{Level: "1,000,001 - 2,000,000", Tax: 0.00},
-				{Level: "2,000,001 ขึ้นไป", Tax: 0.00},
+				{Level: "0 - 150,000", Tax: handler.Baht(0)},
+				{Level: "150,001 - 500,000", Tax: handler.Baht(29000)},
+				{Level: "500,001 - 1,000,000", Tax: handler.Baht(0)},
+				{Level: "1,000,001 - 2,000,000", Tax: handler.Baht(0)},
+				{Level: "2,000,001 ขึ้นไป", Tax: handler.Baht(0)},
 			},
 		}
 		var got handler.ResponseCalculation
@@ -84,53 +110,187 @@ func TestCalculate(t *testing.T) {
 			t.Errorf("expected %v but got %v", want, got)
 		}
 	})
+	t.Run("should return status 400 for unknown allowanceType", func(t *testing.T) {
+		body, err := json.Marshal(handler.RequestCalculation{
+			TotalIncome: handler.Baht(500000),
+			Allowances: []handler.AllowancesArr{
+				{AllowanceType: "donations", Amount: handler.Baht(1000)},
+			},
+		})
+		if err != nil {
+			t.Errorf("Create request failed: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		res := httptest.NewRecorder()
+		e := echo.New()
+		c := e.NewContext(req, res)
+
+		Calculate(c, loadData(database.DataStruct{Allowances: database.DefaultAllowanceRules(), Brackets: database.DefaultBrackets()}))
+
+		if res.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %v but got status %v", http.StatusBadRequest, res.Result().StatusCode)
+		}
+		var got handler.ResponseValidation
+		if err := json.Unmarshal(res.Body.Bytes(), &got); err != nil {
+			t.Errorf("Cannot unmarshal json: %v", err)
+		}
+		if len(got.Errors) != 1 || got.Errors[0].Index != 0 {
+			t.Errorf("expected error at index 0 but got %v", got.Errors)
+		}
+	})
+	t.Run("should return status 400 for unknown taxYear", func(t *testing.T) {
+		body, err := json.Marshal(handler.RequestCalculation{TaxYear: 2550, TotalIncome: handler.Baht(500000)})
+		if err != nil {
+			t.Errorf("Create request failed: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		res := httptest.NewRecorder()
+		e := echo.New()
+		c := e.NewContext(req, res)
+
+		Calculate(c, loadData(database.DataStruct{}))
+
+		if res.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %v but got status %v", http.StatusBadRequest, res.Result().StatusCode)
+		}
+	})
+}
+
+func TestCompute(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	request := handler.RequestCalculation{
+		TotalIncome: handler.Baht(500000),
+		Wht:         handler.Baht(25000),
+		Allowances: []handler.AllowancesArr{
+			{AllowanceType: "donation", Amount: handler.Baht(200000)},
+		},
+	}
+	t.Run("should not return a trace without one", func(t *testing.T) {
+		got, err := Compute(data, request, nil)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got.Trace != nil || got.Tax != handler.Baht(0) || got.TaxRefund != handler.Baht(400) {
+			t.Errorf("expected tax 0 and refund 400 without trace but got %+v", got)
+		}
+	})
+	t.Run("should explain every step", func(t *testing.T) {
+		trace := &Trace{}
+
+		got, err := Compute(data, request, trace)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		var steps []string
+		for _, step := range got.Trace {
+			steps = append(steps, step.Step)
+		}
+		wantSteps := []string{"allowance", "personalAllowance", "taxableIncome", "level", "level", "level", "level", "level", "progressiveTax", "tax", "wht", "taxRefund"}
+		if !reflect.DeepEqual(steps, wantSteps) {
+			t.Errorf("expected steps %v but got %v", wantSteps, steps)
+		}
+		donation := got.Trace[0]
+		if *donation.Requested != handler.Baht(200000) || donation.Amount != handler.Baht(44000) || donation.Note != "limited by the shared cap of group donation" {
+			t.Errorf("expected donation capped at 44000 but got %+v", donation)
+		}
+		level := got.Trace[4]
+		if level.Amount != handler.Baht(246000) || *level.Rate != 0.10 || *level.Tax != handler.Baht(24600) {
+			t.Errorf("expected 246000 taxed 24600 at 10%% but got %+v", level)
+		}
+	})
+}
+
+func loadData(data database.DataStruct) database.Loader {
+	return func(taxYear int) (database.DataStruct, error) {
+		if taxYear != database.DefaultTaxYear {
+			return database.DataStruct{}, fmt.Errorf("%w: %d", database.ErrUnknownTaxYear, taxYear)
+		}
+		data.TaxYear = taxYear
+		return data, nil
+	}
 }
 
 func TestWhtCalculate(t *testing.T) {
 	t.Run("should refund 5000 and tax 0", func(t *testing.T) {
-		wht, taxAmount := 30000.0, 25000.0
+		wht, taxAmount := handler.Baht(30000), handler.Baht(25000)
 
 		actualTaxRefund, actualTaxAmount := WhtCalculate(wht, taxAmount)
 
-		if !reflect.DeepEqual(actualTaxRefund, 5000.0) {
-			t.Errorf("expected %v but got %v", 5000.0, actualTaxRefund)
+		if !reflect.DeepEqual(actualTaxRefund, handler.Baht(5000)) {
+			t.Errorf("expected %v but got %v", handler.Baht(5000), actualTaxRefund)
 		}
-		if !reflect.DeepEqual(actualTaxAmount, 0.0) {
-			t.Errorf("expected %v but got %v", 0.0, actualTaxAmount)
+		if !reflect.DeepEqual(actualTaxAmount, handler.Baht(0)) {
+			t.Errorf("expected %v but got %v", handler.Baht(0), actualTaxAmount)
 		}
 	})
 	t.Run("should refund 0 and tax 5000", func(t *testing.T) {
-		wht, taxAmount := 25000.0, 30000.0
+		wht, taxAmount := handler.Baht(25000), handler.Baht(30000)
 
 		actualTaxRefund, actualTaxAmount := WhtCalculate(wht, taxAmount)
 
-		if !reflect.DeepEqual(actualTaxRefund, 0.0) {
-			t.Errorf("expected %v but got %v", 0.0, actualTaxRefund)
+		if !reflect.DeepEqual(actualTaxRefund, handler.Baht(0)) {
+			t.Errorf("expected %v but got %v", handler.Baht(0), actualTaxRefund)
 		}
-		if !reflect.DeepEqual(actualTaxAmount, 5000.0) {
-			t.Errorf("expected %v but got %v", 5000.0, actualTaxAmount)
+		if !reflect.DeepEqual(actualTaxAmount, handler.Baht(5000)) {
+			t.Errorf("expected %v but got %v", handler.Baht(5000), actualTaxAmount)
 		}
 	})
 }
 
 func TestTaxLevelCalculate(t *testing.T) {
 	t.Run("should return 1", func(t *testing.T) {
-		taxableIncome := 500000.0
+		taxableIncome := handler.Baht(500000)
 		wantTaxLevelsArr := []handler.TaxLevelArr{
-			{Level: "0 - 150,000", Tax: 0.00},
-			{Level: "150,001 - 500,000", Tax: 35000.00},
-			{Level: "500,001 - 1,000,000", Tax: 0.00},
-			{Level: "1,000,001 - 2,000,000", Tax: 0.00},
-			{Level: "2,000,001 ขึ้นไป", Tax: 0.00},
+			{Level: "0 - 150,000", Tax: handler.Baht(0)},
+			{Level: "150,001 - 500,000", Tax: handler.Baht(35000)},
+			{Level: "500,001 - 1,000,000", Tax: handler.Baht(0)},
+			{Level: "1,000,001 - 2,000,000", Tax: handler.Baht(0)},
+			{Level: "2,000,001 ขึ้นไป", Tax: handler.Baht(0)},
 		}
 
-		gotTaxResultTotal, gotTaxLevelsArr := TaxLevelCalculate(taxableIncome)
+		gotTaxResultTotal, gotTaxLevelsArr := TaxLevelCalculate(taxableIncome, LevelDetail, nil)
 
 		if !reflect.DeepEqual(wantTaxLevelsArr, gotTaxLevelsArr) {
 			t.Errorf("expected %v but got %v", wantTaxLevelsArr, gotTaxLevelsArr)
 		}
-		if !reflect.DeepEqual(35000.00, gotTaxResultTotal) {
-			t.Errorf("expected %v but got %v", 35000.00, gotTaxResultTotal)
+		if !reflect.DeepEqual(handler.Baht(35000), gotTaxResultTotal) {
+			t.Errorf("expected %v but got %v", handler.Baht(35000), gotTaxResultTotal)
+		}
+	})
+	t.Run("should tax every boundary without gaps", func(t *testing.T) {
+		cases := map[handler.Money]handler.Money{
+			handler.Baht(150000):    0,
+			handler.Money(15000001): 0,
+			handler.Money(15000050): handler.Money(5),
+			handler.Baht(150001):    handler.Money(10),
+			handler.Baht(500000):    handler.Baht(35000),
+			handler.Money(50000020): handler.Money(3500003),
+			handler.Baht(2000000):   handler.Baht(310000),
+			handler.Baht(2000001):   handler.Money(31000035),
+		}
+
+		for taxableIncome, want := range cases {
+			got, _ := TaxLevelCalculate(taxableIncome, LevelDetail, nil)
+
+			if got != want {
+				t.Errorf("taxable income %v: expected %v but got %v", taxableIncome, want, got)
+			}
+		}
+	})
+	t.Run("should floor negative taxable income at zero", func(t *testing.T) {
+		got, gotTaxLevelsArr := TaxLevelCalculate(handler.Baht(-10000), LevelDetail, nil)
+
+		if got != 0 || len(gotTaxLevelsArr) != len(LevelDetail) {
+			t.Errorf("expected %v with %v levels but got %v with %v levels", 0, len(LevelDetail), got, len(gotTaxLevelsArr))
 		}
 	})
 }
@@ -139,7 +299,16 @@ func TestGetTaxLevel(t *testing.T) {
 	t.Run("should return 1", func(t *testing.T) {
 		level := LevelDetail
 
-		got := GetTaxLevel(500000, level)
+		got := GetTaxLevel(handler.Baht(500000), level)
+
+		if !reflect.DeepEqual(got, 1) {
+			t.Errorf("expected %v but got %v", 1, got)
+		}
+	})
+	t.Run("should return 1 between whole baht", func(t *testing.T) {
+		level := LevelDetail
+
+		got := GetTaxLevel(handler.Money(15000050), level)
 
 		if !reflect.DeepEqual(got, 1) {
 			t.Errorf("expected %v but got %v", 1, got)
@@ -148,7 +317,7 @@ func TestGetTaxLevel(t *testing.T) {
 	t.Run("should return -1", func(t *testing.T) {
 		level := LevelDetail
 
-		got := GetTaxLevel(-1, level)
+		got := GetTaxLevel(handler.Baht(-1), level)
 
 		if !reflect.DeepEqual(got, -1) {
 			t.Errorf("expected %v but got %v", -1, got)
@@ -159,7 +328,7 @@ func TestGetTaxLevel(t *testing.T) {
 
 func TestValidateWht(t *testing.T) {
 	t.Run("should return amount", func(t *testing.T) {
-		amount, totalIncome := 30000.0, 35000.0
+		amount, totalIncome := handler.Baht(30000), handler.Baht(35000)
 		want := amount
 
 		got := ValidateWht(amount, totalIncome)
@@ -169,52 +338,12 @@ func TestValidateWht(t *testing.T) {
 		}
 	})
 	t.Run("should return -1", func(t *testing.T) {
-		amount, totalIncome := 35000.0, 30000.0
+		amount, totalIncome := handler.Baht(35000), handler.Baht(30000)
 
 		got := ValidateWht(amount, totalIncome)
 
-		if !reflect.DeepEqual(got, -1.0) {
-			t.Errorf("expected %v but got %v", -1.0, got)
-		}
-	})
-}
-
-func TestDonationValidate(t *testing.T) {
-	t.Run("should return 100000", func(t *testing.T) {
-		request := &handler.RequestCalculation{
-			TotalIncome: 500000.0,
-			Wht:         0.0,
-			Allowances: []handler.AllowancesArr{
-				{AllowanceType: "donation", Amount: 150000.0},
-			},
-		}
-
-		DonationValidate(request)
-
-		if request.Allowances[0].Amount != 100000.0 {
-			t.Errorf("expected %f, but got %f", 100000.0, request.Allowances[0].Amount)
-		}
-	})
-}
-
-func TestKReceiptValidate(t *testing.T) {
-	t.Run("should return 100000", func(t *testing.T) {
-		request := &handler.RequestCalculation{
-			TotalIncome: 500000.0,
-			Wht:         0.0,
-			Allowances: []handler.AllowancesArr{
-				{AllowanceType: "k-receipt", Amount: 150000.0},
-			},
-		}
-		data := database.DataStruct{
-			PersonalAllowance: 60000.0,
-			MaxKReceipt:       50000.0,
-		}
-
-		KReceiptValidate(data, request)
-
-		if request.Allowances[0].Amount != data.MaxKReceipt {
-			t.Errorf("expected %f, but got %f", data.MaxKReceipt, request.Allowances[0].Amount)
+		if !reflect.DeepEqual(got, handler.Money(-1)) {
+			t.Errorf("expected %v but got %v", handler.Money(-1), got)
 		}
 	})
 }
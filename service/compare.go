@@ -0,0 +1,117 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+// MaxScenarios bounds the number of scenarios one compare request runs.
+const MaxScenarios = 20
+
+func Compare(c echo.Context, load database.Loader) error {
+	var request handler.RequestCompare
+	if err := c.Bind(&request); err != nil {
+		return err
+	}
+	if len(request.Scenarios) > MaxScenarios {
+		return c.JSON(http.StatusBadRequest, Err{Message: fmt.Sprintf("at most %d scenarios are allowed", MaxScenarios)})
+	}
+	request.Base.TaxYear = database.TaxYearOrDefault(request.Base.TaxYear)
+	// Build the scenarios before the base is validated, since validation
+	// resolves its incomes in place.
+	scenarios := make([]handler.RequestCalculation, len(request.Scenarios))
+	seen := map[string]bool{}
+	for i, scenario := range request.Scenarios {
+		if scenario.Name == "" || seen[scenario.Name] {
+			return c.JSON(http.StatusBadRequest, Err{Message: fmt.Sprintf("scenario %d needs a unique name", i)})
+		}
+		seen[scenario.Name] = true
+		var err error
+		if scenarios[i], err = ApplyScenario(request.Base, scenario); err != nil {
+			return c.JSON(http.StatusBadRequest, handler.ResponseScenarioError{Message: "Invalid scenario", Scenario: scenario.Name, Details: Err{Message: err.Error()}})
+		}
+	}
+	// Every scenario is checked and computed against this one load.
+	data, ok, err := PrepareRequest(c, load, &request.Base)
+	if !ok {
+		return err
+	}
+	for i := range scenarios {
+		if invalid := ValidateRequest(data, &scenarios[i]); invalid != nil {
+			return c.JSON(http.StatusBadRequest, handler.ResponseScenarioError{Message: "Invalid scenario", Scenario: request.Scenarios[i].Name, Details: invalid})
+		}
+	}
+	response, err := CompareCalculate(data, request.Base, request.Scenarios, scenarios)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// ApplyScenario returns a copy of base with the overrides of scenario
+// applied. The tax year cannot be overridden.
+func ApplyScenario(base handler.RequestCalculation, scenario handler.Scenario) (handler.RequestCalculation, error) {
+	var request handler.RequestCalculation
+	copied, err := json.Marshal(base)
+	if err != nil {
+		return request, err
+	}
+	if err := json.Unmarshal(copied, &request); err != nil {
+		return request, err
+	}
+	if len(scenario.Overrides) > 0 {
+		if err := json.Unmarshal(scenario.Overrides, &request); err != nil {
+			return request, fmt.Errorf("invalid overrides: %v", err)
+		}
+	}
+	if request.TaxYear != base.TaxYear {
+		return request, fmt.Errorf("taxYear must be the same as the base")
+	}
+	return request, nil
+}
+
+// CompareCalculate computes the base and every scenario with data and
+// diffs each scenario against the base.
+func CompareCalculate(data database.DataStruct, base handler.RequestCalculation, scenarios []handler.Scenario, requests []handler.RequestCalculation) (handler.ResponseCompare, error) {
+	var response handler.ResponseCompare
+	var err error
+	if response.Base, err = Compute(data, base, nil); err != nil {
+		return response, err
+	}
+	response.Scenarios = []handler.ScenarioResult{}
+	for i, request := range requests {
+		result, err := Compute(data, request, nil)
+		if err != nil {
+			return response, err
+		}
+		response.Scenarios = append(response.Scenarios, handler.ScenarioResult{
+			Name:        scenarios[i].Name,
+			Calculation: result,
+			Diff:        DiffCalculation(response.Base, result),
+		})
+	}
+	return response, nil
+}
+
+// DiffCalculation returns result less base. Rate differences are rounded
+// to four decimal places like the rates themselves.
+func DiffCalculation(base, result handler.ResponseCalculation) handler.CalculationDiff {
+	rate := func(a, b float64) float64 { return math.Round((a-b)*10000) / 10000 }
+	return handler.CalculationDiff{
+		TaxRefund:         result.TaxRefund - base.TaxRefund,
+		Tax:               result.Tax - base.Tax,
+		ProgressiveTax:    result.ProgressiveTax - base.ProgressiveTax,
+		GrossIncomeTax:    result.GrossIncomeTax - base.GrossIncomeTax,
+		DonationDeduction: result.DonationDeduction - base.DonationDeduction,
+		ExpenseDeduction:  result.ExpenseDeduction - base.ExpenseDeduction,
+		TaxableIncome:     result.TaxableIncome - base.TaxableIncome,
+		EffectiveRate:     rate(result.EffectiveRate, base.EffectiveRate),
+		MarginalRate:      rate(result.MarginalRate, base.MarginalRate),
+	}
+}
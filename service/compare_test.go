@@ -0,0 +1,76 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+func TestCompare(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	compare := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		res := httptest.NewRecorder()
+		Compare(echo.New().NewContext(req, res), loadData(data))
+		return res
+	}
+	t.Run("should diff every scenario against the base", func(t *testing.T) {
+		res := compare(`{"base": {"totalIncome": 500000, "wht": 0, "allowances": []},
+			"scenarios": [
+				{"name": "rmf", "overrides": {"allowances": [{"allowanceType": "rmf", "amount": 100000}]}},
+				{"name": "wht", "overrides": {"wht": 30000}}
+			]}`)
+
+		if res.Result().StatusCode != http.StatusOK {
+			t.Errorf("expected status %v but got status %v", http.StatusOK, res.Result().StatusCode)
+		}
+		var got handler.ResponseCompare
+		if err := json.Unmarshal(res.Body.Bytes(), &got); err != nil {
+			t.Errorf("Cannot unmarshal json: %v", err)
+		}
+		if got.Base.Tax != handler.Baht(29000) || len(got.Scenarios) != 2 {
+			t.Errorf("expected base tax 29000 and 2 scenarios but got %v and %v", got.Base.Tax, len(got.Scenarios))
+			return
+		}
+		rmf := got.Scenarios[0]
+		if rmf.Name != "rmf" || rmf.Calculation.Tax != handler.Baht(19000) || rmf.Diff.Tax != handler.Baht(-10000) || rmf.Diff.TaxableIncome != handler.Baht(-100000) {
+			t.Errorf("unexpected rmf scenario %+v", rmf)
+		}
+		wht := got.Scenarios[1]
+		if wht.Diff.Tax != handler.Baht(-29000) || wht.Diff.TaxRefund != handler.Baht(1000) || wht.Diff.ProgressiveTax != 0 {
+			t.Errorf("unexpected wht scenario %+v", wht)
+		}
+	})
+	t.Run("should return status 400 for an invalid scenario", func(t *testing.T) {
+		res := compare(`{"base": {"totalIncome": 500000, "wht": 0, "allowances": []},
+			"scenarios": [{"name": "wht", "overrides": {"wht": 600000}}]}`)
+
+		if res.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %v but got status %v", http.StatusBadRequest, res.Result().StatusCode)
+		}
+		var got handler.ResponseScenarioError
+		if err := json.Unmarshal(res.Body.Bytes(), &got); err != nil || got.Scenario != "wht" {
+			t.Errorf("expected an error for scenario wht but got %s", res.Body.String())
+		}
+	})
+	t.Run("should return status 400 for a scenario in another tax year", func(t *testing.T) {
+		res := compare(`{"base": {"totalIncome": 500000, "wht": 0, "allowances": []},
+			"scenarios": [{"name": "old", "overrides": {"taxYear": 2560}}]}`)
+
+		if res.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %v but got status %v", http.StatusBadRequest, res.Result().StatusCode)
+		}
+	})
+}
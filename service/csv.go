@@ -2,80 +2,309 @@ package service
 
 import (
 	"encoding/csv"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/Bgarnn/assessment-tax/database"
 	handler "github.com/Bgarnn/assessment-tax/struct"
 	"github.com/labstack/echo"
+	"github.com/xuri/excelize/v2"
 )
 
 type Err struct {
 	Message string `json:"message"`
 }
 
-func Csv(c echo.Context, dt database.DataStruct) error {
-	var response []handler.ResponseCSV
-	file, err := c.FormFile("taxFile")
-	if err != nil {
-		return c.JSON(http.StatusNotFound, Err{Message: "taxFile(FormFile) error"})
+// Columns a CSV header may have besides allowance columns.
+const (
+	ColumnTotalIncome = "totalIncome"
+	ColumnWht         = "wht"
+	ColumnTaxYear     = "taxYear"
+)
+
+// CSV modes. In ModeAllOrNothing any error fails the whole file; in
+// ModeBestEffort the valid rows are calculated and returned with the errors.
+const (
+	ModeAllOrNothing = "all-or-nothing"
+	ModeBestEffort   = "best-effort"
+)
+
+// CSV output formats. FormatJSON streams a handler.ResponseCSVReport,
+// FormatNDJSON one handler.CSVLine per line and FormatXlsx a workbook with
+// a results sheet and an errors sheet.
+const (
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+	FormatXlsx   = "xlsx"
+)
+
+// Csv checks the whole file first, so that a bad file is rejected with a
+// 400 before any result is sent, then streams the results of a second
+// read. Neither read holds more than the errors and the rows in flight.
+// A taxFile named *.xlsx is read from the first sheet of the workbook with
+// the same header mapping.
+func Csv(c echo.Context, load database.Loader, limits CsvLimits) error {
+	mode := c.QueryParam("mode")
+	if mode == "" {
+		mode = ModeAllOrNothing
+	}
+	if mode != ModeAllOrNothing && mode != ModeBestEffort {
+		return c.JSON(http.StatusBadRequest, Err{Message: "Invalid mode"})
+	}
+	format := c.QueryParam("format")
+	if format == "" {
+		format = FormatJSON
+	}
+	if format != FormatJSON && format != FormatNDJSON && format != FormatXlsx {
+		return c.JSON(http.StatusBadRequest, Err{Message: "Invalid format"})
+	}
+	file, ok, err := TaxFile(c, limits.MaxBytes)
+	if !ok {
+		return err
 	}
 	src, err := file.Open()
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, Err{Message: "taxFile(fileOpen) error"})
 	}
 	defer src.Close()
-	reader := csv.NewReader(src)
-	data, err := reader.ReadAll()
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, Err{Message: "taxFile(ReadAll) error"})
-	}
-	for i, record := range data {
-		if i == 0 {
-			continue
+	rows := func() (RowReader, error) {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return nil, err
 		}
-		totalIncome, wht, donation, err := ParseData(record)
+		return newCsvReader(src), nil
+	}
+	if strings.EqualFold(filepath.Ext(file.Filename), ".xlsx") {
+		book, err := excelize.OpenReader(src, XlsxOptions(limits))
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, Err{Message: "ParseData error"})
+			return c.JSON(http.StatusBadRequest, Err{Message: "taxFile(xlsx) error: " + err.Error()})
 		}
-		taxableIncome := totalIncome - dt.PersonalAllowance - donation
-		taxAmount, _ := TaxLevelCalculate(taxableIncome)
-		var taxRefund float64
-		taxRefund, taxAmount = WhtCalculate(wht, taxAmount)
-		response = append(response, handler.ResponseCSV{TotalIncome: totalIncome, Tax: taxAmount, TaxRefund: taxRefund})
+		defer book.Close()
+		rows = func() (RowReader, error) { return XlsxRows(book) }
 	}
-	return c.JSON(http.StatusOK, response)
+
+	reader, err := rows()
+	if err == nil {
+		var plan CsvPlan
+		plan, err = ScanRows(reader, load, limits.MaxRows)
+		if err == nil {
+			return csvResults(c, plan, rows, mode, format, limits.Workers)
+		}
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) || errors.Is(err, ErrUnreadableSheet) {
+		return c.JSON(http.StatusBadRequest, Err{Message: "taxFile(Read) error: " + err.Error()})
+	}
+	if errors.Is(err, ErrTooManyRows) {
+		return c.JSON(http.StatusRequestEntityTooLarge, Err{Message: fmt.Sprintf("%v, at most %d", err, limits.MaxRows)})
+	}
+	return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
 }
 
-func ParseData(record []string) (float64, float64, float64, error) {
-	totalIncome, err := strconv.ParseFloat(record[0], 64)
-	if err != nil {
-		log.Printf("Invalid totalIncome: %v, error: %v", record[0], err)
-		return 0, 0, 0, err
+// csvResults answers a scanned upload, reading its rows again from rows.
+func csvResults(c echo.Context, plan CsvPlan, rows func() (RowReader, error), mode, format string, workers int) error {
+	if plan.Rejected(mode) {
+		return c.JSON(http.StatusBadRequest, handler.ResponseCSVReport{Taxes: []handler.ResponseCSV{}, Errors: plan.Errors})
 	}
-	wht, err := strconv.ParseFloat(record[1], 64)
+	reader, err := rows()
 	if err != nil {
-		log.Printf("Invalid wht: %v, error: %v", record[1], err)
-		return 0, 0, 0, err
+		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	}
+	stream := func(emit func(handler.CSVLine) error) error {
+		return plan.StreamRows(reader, workers, 0, emit)
 	}
-	wht = ValidateWht(wht, totalIncome)
-	if wht == -1 {
-		log.Printf("Invalid wht")
-		return 0, 0, 0, err
+
+	res := c.Response()
+	switch format {
+	case FormatNDJSON:
+		res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		res.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(res)
+		return stream(func(line handler.CSVLine) error {
+			return encoder.Encode(line)
+		})
+	case FormatXlsx:
+		res.Header().Set(echo.HeaderContentType, MIMEXlsx)
+		res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="taxes.xlsx"`)
+		res.WriteHeader(http.StatusOK)
+		return writeXlsx(res, stream)
 	}
-	donation, err := strconv.ParseFloat(record[2], 64)
+	res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	res.WriteHeader(http.StatusOK)
+	return writeReport(res, stream)
+}
+
+// writeReport writes a handler.ResponseCSVReport as its taxes are
+// produced. Errors are kept until the taxes are done.
+func writeReport(w io.Writer, stream func(emit func(handler.CSVLine) error) error) error {
+	if _, err := io.WriteString(w, `{"taxes":[`); err != nil {
+		return err
+	}
+	var errs []handler.CSVError
+	first := true
+	err := stream(func(line handler.CSVLine) error {
+		if line.Error != nil {
+			errs = append(errs, *line.Error)
+			return nil
+		}
+		b, err := json.Marshal(line.Tax)
+		if err != nil {
+			return err
+		}
+		if !first {
+			b = append([]byte{','}, b...)
+		}
+		first = false
+		_, err = w.Write(b)
+		return err
+	})
 	if err != nil {
-		log.Printf("Invalid donation: %v, error: %v", record[2], err)
-		return 0, 0, 0, err
+		return err
+	}
+	tail := []byte("]")
+	if len(errs) > 0 {
+		b, err := json.Marshal(errs)
+		if err != nil {
+			return err
+		}
+		tail = append(append([]byte(`],"errors":`), b...), '}')
+	} else {
+		tail = append(tail, '}')
+	}
+	tail = append(tail, '\n')
+	_, err = w.Write(tail)
+	return err
+}
+
+// RowErrors validates a parsed row like ValidateRequest does, naming the
+// column of every error it can.
+func RowErrors(data database.DataStruct, request *handler.RequestCalculation) []handler.CSVError {
+	var errs []handler.CSVError
+	if request.TotalIncome < 0 {
+		errs = append(errs, handler.CSVError{Column: ColumnTotalIncome, Reason: "totalIncome must not be negative"})
+	} else if ValidateWht(request.Wht, request.TotalIncome) == -1 {
+		errs = append(errs, handler.CSVError{Column: ColumnWht, Reason: "wht must be between 0 and totalIncome"})
+	}
+	for _, e := range ValidateAllowances(data, request.Allowances) {
+		errs = append(errs, handler.CSVError{Column: request.Allowances[e.Index].Key(), Reason: e.Reason})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	if invalid := ValidateRequest(data, request); invalid != nil {
+		return []handler.CSVError{{Reason: Describe(invalid)}}
 	}
-	donation = ValidateDonation(donation)
-	return totalIncome, wht, donation, nil
+	return nil
 }
 
-func ValidateDonation(amount float64) float64 {
-	if amount > 100000 {
-		return 100000
+// Describe renders the body ValidateRequest returns as one line.
+func Describe(invalid any) string {
+	switch v := invalid.(type) {
+	case Err:
+		return v.Message
+	case handler.ResponseValidation:
+		reasons := make([]string, 0, len(v.Errors))
+		for _, e := range v.Errors {
+			reasons = append(reasons, e.Reason)
+		}
+		return v.Message + ": " + strings.Join(reasons, ", ")
+	}
+	return fmt.Sprint(invalid)
+}
+
+// Header maps the columns of a CSV file by name. Every column other than
+// totalIncome, wht and taxYear is an allowance, named by allowanceType or
+// by allowanceType/subtype such as donation/education.
+type Header struct {
+	Columns    []string
+	Allowances []handler.AllowancesArr
+}
+
+// ParseHeader reads the first row of a CSV file. totalIncome is required,
+// and a column may not be empty or repeated.
+func ParseHeader(record []string) (Header, error) {
+	header := Header{Columns: make([]string, len(record))}
+	seen := map[string]bool{}
+	for i, name := range record {
+		name = strings.TrimSpace(name)
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		if name == "" {
+			return header, fmt.Errorf("column %d has no name", i+1)
+		}
+		if seen[name] {
+			return header, fmt.Errorf("column %q is repeated", name)
+		}
+		seen[name] = true
+		header.Columns[i] = name
+		switch name {
+		case ColumnTotalIncome, ColumnWht, ColumnTaxYear:
+		default:
+			allowanceType, subtype, _ := strings.Cut(name, "/")
+			header.Allowances = append(header.Allowances, handler.AllowancesArr{AllowanceType: allowanceType, Subtype: subtype})
+		}
+	}
+	if !seen[ColumnTotalIncome] {
+		return header, fmt.Errorf("column %q is required", ColumnTotalIncome)
+	}
+	return header, nil
+}
+
+// Check reports the allowance columns that the rules of data do not
+// support as errors on the header line.
+func (h Header) Check(data database.DataStruct) []handler.CSVError {
+	var errs []handler.CSVError
+	for _, e := range ValidateAllowances(data, h.Allowances) {
+		if e.Field == "allowanceType" || e.Field == "subtype" {
+			errs = append(errs, handler.CSVError{Line: 1, Column: h.Allowances[e.Index].Key(), Reason: "unknown column"})
+		}
+	}
+	return errs
+}
+
+// Parse reads one row into the request the JSON endpoint would receive
+// and reports every cell it cannot read. Empty allowance cells are skipped
+// and an empty wht is 0. The tax year defaults to database.DefaultTaxYear.
+func (h Header) Parse(record []string) (handler.RequestCalculation, []handler.CSVError) {
+	request := handler.RequestCalculation{TaxYear: database.DefaultTaxYear, Allowances: []handler.AllowancesArr{}}
+	if len(record) != len(h.Columns) {
+		return request, []handler.CSVError{{Reason: fmt.Sprintf("expected %d columns but got %d", len(h.Columns), len(record))}}
+	}
+	var errs []handler.CSVError
+	allowance := 0
+	for i, name := range h.Columns {
+		value := strings.TrimSpace(record[i])
+		var err error
+		switch name {
+		case ColumnTotalIncome:
+			request.TotalIncome, err = handler.ParseMoney(value)
+		case ColumnWht:
+			if value != "" {
+				request.Wht, err = handler.ParseMoney(value)
+			}
+		case ColumnTaxYear:
+			if value != "" {
+				request.TaxYear, err = strconv.Atoi(value)
+			}
+		default:
+			a := h.Allowances[allowance]
+			allowance++
+			if value == "" {
+				continue
+			}
+			if a.Amount, err = handler.ParseMoney(value); err == nil {
+				request.Allowances = append(request.Allowances, a)
+			}
+		}
+		if err != nil {
+			errs = append(errs, handler.CSVError{Column: name, Reason: fmt.Sprintf("invalid %s: %q", name, value)})
+		}
 	}
-	return amount
+	return request, errs
 }
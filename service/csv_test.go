@@ -1,26 +1,335 @@
 package service
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
 )
 
-func TestValidateDonation(t *testing.T) {
-	t.Run("should return 100000", func(t *testing.T) {
-		amount := 200000.0
+func TestParseHeader(t *testing.T) {
+	t.Run("should map allowance columns by name", func(t *testing.T) {
+		got, err := ParseHeader([]string{"k-receipt", "totalIncome", "donation/education", "wht"})
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		want := []handler.AllowancesArr{{AllowanceType: "k-receipt"}, {AllowanceType: "donation", Subtype: "education"}}
+		if !reflect.DeepEqual(got.Allowances, want) {
+			t.Errorf("expected %v but got %v", want, got.Allowances)
+		}
+	})
+	t.Run("should require totalIncome", func(t *testing.T) {
+		_, err := ParseHeader([]string{"wht", "donation"})
+
+		if err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+	t.Run("should reject a repeated column", func(t *testing.T) {
+		_, err := ParseHeader([]string{"totalIncome", "wht", "wht"})
+
+		if err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
+
+func TestHeaderCheck(t *testing.T) {
+	data := database.DataStruct{Allowances: database.DefaultAllowanceRules()}
+	t.Run("should reject an unknown column", func(t *testing.T) {
+		header, _ := ParseHeader([]string{"totalIncome", "donation", "lottery"})
+
+		got := header.Check(data)
+
+		want := []handler.CSVError{{Line: 1, Column: "lottery", Reason: "unknown column"}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+	t.Run("should accept every allowance of the registry", func(t *testing.T) {
+		header, _ := ParseHeader([]string{"totalIncome", "donation", "k-receipt", "rmf", "donation/education"})
+
+		got := header.Check(data)
+
+		if len(got) != 0 {
+			t.Errorf("unexpected errors: %v", got)
+		}
+	})
+}
+
+func TestHeaderParse(t *testing.T) {
+	header, _ := ParseHeader([]string{"wht", "totalIncome", "k-receipt", "donation", "taxYear"})
+	t.Run("should read columns in any order", func(t *testing.T) {
+		got, errs := header.Parse([]string{"40000", "600000", "50000", "", "2566"})
+
+		if len(errs) != 0 {
+			t.Errorf("unexpected errors: %v", errs)
+		}
+		want := handler.RequestCalculation{
+			TaxYear:     2566,
+			TotalIncome: handler.Baht(600000),
+			Wht:         handler.Baht(40000),
+			Allowances:  []handler.AllowancesArr{{AllowanceType: "k-receipt", Amount: handler.Baht(50000)}},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+	t.Run("should default taxYear", func(t *testing.T) {
+		got, errs := header.Parse([]string{"0", "500000", "", "0", ""})
+
+		if len(errs) != 0 || got.TaxYear != 2567 {
+			t.Errorf("expected %v, but got %v (%v)", 2567, got.TaxYear, errs)
+		}
+	})
+	t.Run("should reject an invalid amount", func(t *testing.T) {
+		_, got := header.Parse([]string{"0", "abc", "", "x", ""})
+
+		want := []handler.CSVError{
+			{Column: "totalIncome", Reason: `invalid totalIncome: "abc"`},
+			{Column: "donation", Reason: `invalid donation: "x"`},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+}
+
+func TestCsvScan(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	t.Run("should report every invalid row", func(t *testing.T) {
+		file := "totalIncome,wht,donation,taxYear\n" +
+			"500000,0,0,\n" +
+			"500000,600000,0,\n" +
+			"500000,0,-1,\n" +
+			"500000,0,0,2500\n" +
+			"500000,0\n"
+
+		got, err := CsvScan(strings.NewReader(file), loadData(data), 10)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		want := []handler.CSVError{
+			{Line: 3, Column: "wht", Reason: "wht must be between 0 and totalIncome"},
+			{Line: 4, Column: "donation", Reason: "amount must not be negative"},
+			{Line: 5, Column: "taxYear", Reason: "Unsupported taxYear: 2500"},
+			{Line: 6, Reason: "expected 4 columns but got 2"},
+		}
+		if !reflect.DeepEqual(got.Errors, want) {
+			t.Errorf("expected %v but got %v", want, got.Errors)
+		}
+	})
+	t.Run("should stop at an unknown column", func(t *testing.T) {
+		got, err := CsvScan(strings.NewReader("totalIncome,lottery\n500000,10\n"), loadData(data), 10)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		want := []handler.CSVError{{Line: 1, Column: "lottery", Reason: "unknown column"}}
+		if !reflect.DeepEqual(got.Errors, want) {
+			t.Errorf("expected %v but got %v", want, got.Errors)
+		}
+	})
+	for name, file := range map[string]string{"no rows": "totalIncome,lottery\n", "only invalid rows": "totalIncome,lottery\nabc,10\n"} {
+		t.Run("should report an unknown column with "+name, func(t *testing.T) {
+			got, err := CsvScan(strings.NewReader(file), loadData(data), 10)
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			want := []handler.CSVError{{Line: 1, Column: "lottery", Reason: "unknown column"}}
+			if !reflect.DeepEqual(got.Errors, want) {
+				t.Errorf("expected %v but got %v", want, got.Errors)
+			}
+		})
+	}
+	t.Run("should reject more rows than allowed", func(t *testing.T) {
+		_, err := CsvScan(strings.NewReader("totalIncome\n1\n2\n3\n"), loadData(data), 2)
+
+		if !errors.Is(err, ErrTooManyRows) {
+			t.Errorf("expected ErrTooManyRows but got %v", err)
+		}
+	})
+}
+
+func TestCsvStream(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Brackets:          database.DefaultBrackets(),
+	}
+	t.Run("should keep the file order with many workers", func(t *testing.T) {
+		var file strings.Builder
+		file.WriteString("totalIncome,wht\n")
+		for i := range 1000 {
+			fmt.Fprintf(&file, "%d,0\n", 200000+i*1000)
+		}
+		file.WriteString("1,2\n")
+		plan, err := CsvScan(strings.NewReader(file.String()), loadData(data), 2000)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		var got []handler.CSVLine
+		err = plan.Stream(strings.NewReader(file.String()), 8, func(line handler.CSVLine) error {
+			got = append(got, line)
+			return nil
+		})
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if len(got) != 1001 {
+			t.Errorf("expected 1001 lines but got %v", len(got))
+			return
+		}
+		for i, line := range got[:1000] {
+			if line.Tax == nil || line.Tax.Line != i+2 || line.Tax.TotalIncome != handler.Baht(int64(200000+i*1000)) {
+				t.Errorf("expected line %v in order but got %+v", i+2, line)
+				return
+			}
+		}
+		if got[1000].Error == nil || got[1000].Error.Line != 1002 {
+			t.Errorf("expected an error on line 1002 but got %+v", got[1000])
+		}
+	})
+	t.Run("should report the line of the file past blank lines and quoted line breaks", func(t *testing.T) {
+		file := "totalIncome,wht\n\n500000,600000\n\"500000\n\",0\nabc,0\n"
+		plan, err := CsvScan(strings.NewReader(file), loadData(data), 10)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		var got []int
+		err = plan.StreamFrom(strings.NewReader(file), 2, 1, func(line handler.CSVLine) error {
+			got = append(got, line.Line())
+			return nil
+		})
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if len(plan.Errors) != 2 || plan.Errors[0].Line != 3 || plan.Errors[1].Line != 6 {
+			t.Errorf("expected errors on lines 3 and 6 but got %v", plan.Errors)
+		}
+		if want := []int{4, 6}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected lines %v after the first row but got %v", want, got)
+		}
+	})
+	t.Run("should stop when emit fails", func(t *testing.T) {
+		file := "totalIncome\n1\n2\n3\n4\n5\n"
+		plan, _ := CsvScan(strings.NewReader(file), loadData(data), 10)
+		stop := errors.New("stop")
+		emitted := 0
+
+		err := plan.Stream(strings.NewReader(file), 2, func(handler.CSVLine) error {
+			emitted++
+			return stop
+		})
+
+		if err != stop || emitted != 1 {
+			t.Errorf("expected to stop after one line but got %v after %v", err, emitted)
+		}
+	})
+}
+
+func TestCsv(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	upload := func(query string, limits CsvLimits) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		part, _ := form.CreateFormFile("taxFile", "taxes.csv")
+		part.Write([]byte("totalIncome,wht,donation\n500000,0,0\n500000,600000,0\n"))
+		form.Close()
+		req := httptest.NewRequest(http.MethodPost, "/?"+query, body)
+		req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+		res := httptest.NewRecorder()
+		Csv(echo.New().NewContext(req, res), loadData(data), limits)
+		return res
+	}
+	t.Run("should fail the whole file in all-or-nothing mode", func(t *testing.T) {
+		res := upload("", DefaultCsvLimits())
+
+		if res.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %v but got status %v", http.StatusBadRequest, res.Result().StatusCode)
+		}
+		var got handler.ResponseCSVReport
+		json.Unmarshal(res.Body.Bytes(), &got)
+		if len(got.Taxes) != 0 || len(got.Errors) != 1 {
+			t.Errorf("expected only errors but got %v", got)
+		}
+	})
+	t.Run("should return the valid rows in best-effort mode", func(t *testing.T) {
+		res := upload("mode="+ModeBestEffort, DefaultCsvLimits())
+
+		if res.Result().StatusCode != http.StatusOK {
+			t.Errorf("expected status %v but got status %v", http.StatusOK, res.Result().StatusCode)
+		}
+		var got handler.ResponseCSVReport
+		if err := json.Unmarshal(res.Body.Bytes(), &got); err != nil {
+			t.Errorf("Cannot unmarshal json: %v", err)
+		}
+		if len(got.Taxes) != 1 || len(got.Errors) != 1 {
+			t.Errorf("expected one tax and one error but got %v", got)
+		}
+	})
+	t.Run("should stream one result per line as ndjson", func(t *testing.T) {
+		res := upload("mode="+ModeBestEffort+"&format="+FormatNDJSON, DefaultCsvLimits())
+
+		want := `{"tax":{"line":2,"totalIncome":500000,"tax":29000}}` + "\n" +
+			`{"error":{"line":3,"column":"wht","reason":"wht must be between 0 and totalIncome"}}` + "\n"
+		if res.Body.String() != want {
+			t.Errorf("expected %q but got %q", want, res.Body.String())
+		}
+	})
+	t.Run("should reject a file larger than allowed", func(t *testing.T) {
+		limits := DefaultCsvLimits()
+		limits.MaxBytes = 10
 
-		got := ValidateDonation(amount)
+		res := upload("", limits)
 
-		if got != 100000.0 {
-			t.Errorf("expected %f, but got %f", 100000.0, got)
+		if res.Result().StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status %v but got status %v", http.StatusRequestEntityTooLarge, res.Result().StatusCode)
 		}
 	})
-	t.Run("should return 10000", func(t *testing.T) {
-		amount := 10000.0
+	t.Run("should stop reading a body larger than allowed", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		form.WriteField("padding", strings.Repeat("x", 2<<20))
+		part, _ := form.CreateFormFile("taxFile", "taxes.csv")
+		part.Write([]byte("totalIncome\n500000\n"))
+		form.Close()
+		req := httptest.NewRequest(http.MethodPost, "/", body)
+		req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+		res := httptest.NewRecorder()
+		limits := DefaultCsvLimits()
+		limits.MaxBytes = 10
 
-		got := ValidateDonation(amount)
+		Csv(echo.New().NewContext(req, res), loadData(data), limits)
 
-		if got != 10000.0 {
-			t.Errorf("expected %f, but got %f", 10000.0, got)
+		if res.Result().StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status %v but got status %v", http.StatusRequestEntityTooLarge, res.Result().StatusCode)
 		}
 	})
 }
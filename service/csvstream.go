@@ -0,0 +1,299 @@
+package service
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"runtime"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+var ErrTooManyRows = errors.New("taxFile has too many rows")
+
+// CsvLimits bounds a CSV upload. Workers is the number of rows calculated
+// at the same time.
+type CsvLimits struct {
+	MaxBytes int64
+	MaxRows  int
+	Workers  int
+}
+
+func DefaultCsvLimits() CsvLimits {
+	return CsvLimits{MaxBytes: 50 << 20, MaxRows: 500000, Workers: runtime.NumCPU()}
+}
+
+// formOverhead is the room left in a request body for the multipart
+// boundaries, part headers and form values around a file.
+const formOverhead = 1 << 20
+
+// TaxFile returns the taxFile of a multipart upload, answering like
+// PrepareRequest when it fails. The request body is cut off a little past
+// maxBytes, so a larger upload gets a 413 before it is buffered to memory
+// or disk, and a missing file a 404.
+func TaxFile(c echo.Context, maxBytes int64) (file *multipart.FileHeader, ok bool, err error) {
+	tooLarge := func() (*multipart.FileHeader, bool, error) {
+		return nil, false, c.JSON(http.StatusRequestEntityTooLarge, Err{Message: fmt.Sprintf("taxFile is larger than %d bytes", maxBytes)})
+	}
+	req := c.Request()
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, maxBytes+formOverhead)
+	file, err = c.FormFile("taxFile")
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return tooLarge()
+	}
+	if err != nil {
+		return nil, false, c.JSON(http.StatusNotFound, Err{Message: "taxFile(FormFile) error"})
+	}
+	if file.Size > maxBytes {
+		return tooLarge()
+	}
+	return file, true, nil
+}
+
+// CsvPlan is what a first read of a CSV file learns: its header and the
+// line it is on, its number of data rows, the rules of every tax year it
+// uses and the errors of every row.
+type CsvPlan struct {
+	Header     Header
+	HeaderLine int
+	Rows       int
+	Years      map[int]database.DataStruct
+	Unknown    map[int]bool
+	Errors     []handler.CSVError
+}
+
+// Rejected reports whether the file fails as a whole in mode: errors on
+// the header fail it in either mode, errors on any row in all-or-nothing.
+func (p CsvPlan) Rejected(mode string) bool {
+	return len(p.Errors) > 0 && (mode == ModeAllOrNothing || p.Errors[0].Line <= p.HeaderLine)
+}
+
+// RowReader reads the rows of an uploaded sheet one at a time, with the
+// line of the file each row starts on, and returns io.EOF after the last.
+type RowReader interface {
+	Read() (record []string, line int, err error)
+}
+
+// csvRows reads a CSV file. Blank lines are skipped and a quoted field may
+// span lines, so the line of a row is not its count.
+type csvRows struct {
+	reader *csv.Reader
+}
+
+func newCsvReader(r io.Reader) RowReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	return csvRows{reader}
+}
+
+func (r csvRows) Read() ([]string, int, error) {
+	record, err := r.reader.Read()
+	if err != nil {
+		return nil, 0, err
+	}
+	line, _ := r.reader.FieldPos(0)
+	return record, line, nil
+}
+
+// CsvScan reads a CSV file once without calculating it. It loads the rules
+// of database.DefaultTaxYear and of every tax year in the file and checks
+// the header against each; when the header fails, Errors holds only the
+// header errors. The error is for an unreadable file, more than maxRows
+// rows or rules that fail to load.
+func CsvScan(r io.Reader, load database.Loader, maxRows int) (CsvPlan, error) {
+	return ScanRows(newCsvReader(r), load, maxRows)
+}
+
+// ScanRows is CsvScan for any RowReader.
+func ScanRows(reader RowReader, load database.Loader, maxRows int) (CsvPlan, error) {
+	plan := CsvPlan{HeaderLine: 1, Years: map[int]database.DataStruct{}, Unknown: map[int]bool{}}
+	record, line, err := reader.Read()
+	if err == io.EOF {
+		plan.Errors = []handler.CSVError{{Line: 1, Reason: "header is required"}}
+		return plan, nil
+	}
+	if err != nil {
+		return plan, err
+	}
+	plan.HeaderLine = line
+	if plan.Header, err = ParseHeader(record); err != nil {
+		plan.Errors = []handler.CSVError{{Line: line, Reason: err.Error()}}
+		return plan, nil
+	}
+	var headerErrs []handler.CSVError
+	loadYear := func(taxYear int) error {
+		if _, ok := plan.Years[taxYear]; ok || plan.Unknown[taxYear] {
+			return nil
+		}
+		dt, err := load(taxYear)
+		if errors.Is(err, database.ErrUnknownTaxYear) {
+			plan.Unknown[taxYear] = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range plan.Header.Check(dt) {
+			e.Line = plan.HeaderLine
+			headerErrs = append(headerErrs, e)
+		}
+		plan.Years[taxYear] = dt
+		return nil
+	}
+	// Check the header before any row, so that an unknown column is
+	// reported even when no row loads a tax year.
+	if err := loadYear(database.DefaultTaxYear); err != nil {
+		return plan, err
+	}
+	for {
+		record, line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return plan, err
+		}
+		if plan.Rows++; plan.Rows > maxRows {
+			return plan, ErrTooManyRows
+		}
+		request, errs := plan.Header.Parse(record)
+		if len(errs) == 0 {
+			if err := loadYear(request.TaxYear); err != nil {
+				return plan, err
+			}
+		}
+		if len(headerErrs) > 0 {
+			continue
+		}
+		_, errs = plan.Validate(request, errs)
+		for _, e := range errs {
+			e.Line = line
+			plan.Errors = append(plan.Errors, e)
+		}
+	}
+	if len(headerErrs) > 0 {
+		plan.Errors = headerErrs
+	}
+	return plan, nil
+}
+
+// Validate finishes checking a parsed row, given the errors of parsing it.
+// Every tax year of the file must have been scanned.
+func (p CsvPlan) Validate(request handler.RequestCalculation, errs []handler.CSVError) (handler.RequestCalculation, []handler.CSVError) {
+	if len(errs) > 0 {
+		return request, errs
+	}
+	if p.Unknown[request.TaxYear] {
+		return request, []handler.CSVError{{Column: ColumnTaxYear, Reason: fmt.Sprintf("Unsupported taxYear: %d", request.TaxYear)}}
+	}
+	return request, RowErrors(p.Years[request.TaxYear], &request)
+}
+
+// Row calculates one row of the file, or returns its errors.
+func (p CsvPlan) Row(line int, record []string) ([]handler.CSVLine, error) {
+	request, errs := p.Validate(p.Header.Parse(record))
+	if len(errs) > 0 {
+		lines := make([]handler.CSVLine, len(errs))
+		for i := range errs {
+			errs[i].Line = line
+			lines[i] = handler.CSVLine{Error: &errs[i]}
+		}
+		return lines, nil
+	}
+	result, err := Compute(p.Years[request.TaxYear], request, nil)
+	if err != nil {
+		return nil, err
+	}
+	tax := handler.ResponseCSV{Line: line, TotalIncome: request.TotalIncome, Tax: result.Tax, TaxRefund: result.TaxRefund}
+	return []handler.CSVLine{{Tax: &tax}}, nil
+}
+
+// Stream reads the file scanned into p again and calculates its rows on
+// workers goroutines, passing the results to emit in file order. At most
+// twice as many rows as workers are read ahead of emit. Stream stops at
+// the first error, including one returned by emit.
+func (p CsvPlan) Stream(r io.Reader, workers int, emit func(handler.CSVLine) error) error {
+	return p.StreamFrom(r, workers, 0, emit)
+}
+
+// StreamFrom is Stream after the first skip data rows, which resumes a
+// stream whose earlier rows were already handled.
+func (p CsvPlan) StreamFrom(r io.Reader, workers, skip int, emit func(handler.CSVLine) error) error {
+	return p.StreamRows(newCsvReader(r), workers, skip, emit)
+}
+
+// StreamRows is StreamFrom for any RowReader.
+func (p CsvPlan) StreamRows(reader RowReader, workers, skip int, emit func(handler.CSVLine) error) error {
+	workers = max(workers, 1)
+	type result struct {
+		lines []handler.CSVLine
+		err   error
+	}
+	if _, _, err := reader.Read(); err != nil {
+		return err
+	}
+	jobs := make(chan func(), workers)
+	queue := make(chan chan result, 2*workers)
+	done := make(chan struct{})
+	defer close(done)
+	for range workers {
+		go func() {
+			for job := range jobs {
+				job()
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		defer close(jobs)
+		for row := 1; ; row++ {
+			record, line, err := reader.Read()
+			if err == io.EOF {
+				return
+			}
+			if err == nil && row <= skip {
+				continue
+			}
+			out := make(chan result, 1)
+			if err != nil {
+				out <- result{err: err}
+			} else {
+				job := func() {
+					lines, err := p.Row(line, record)
+					out <- result{lines, err}
+				}
+				select {
+				case jobs <- job:
+				case <-done:
+					return
+				}
+			}
+			select {
+			case queue <- out:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for out := range queue {
+		r := <-out
+		if r.err != nil {
+			return r.err
+		}
+		for _, line := range r.lines {
+			if err := emit(line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+// MaxCurvePoints bounds the number of incomes one curve request computes.
+const MaxCurvePoints = 10000
+
+// TaxCurve computes the tax across ?from=&to=&step= for a taxpayer who
+// claims only the personal allowance. from defaults to 0 and to is
+// included when the step lands on it.
+func TaxCurve(c echo.Context, load database.Loader) error {
+	from, to, step, err := curveRange(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	taxYear := database.DefaultTaxYear
+	if param := c.QueryParam("taxYear"); param != "" {
+		if taxYear, err = strconv.Atoi(param); err != nil {
+			return c.JSON(http.StatusBadRequest, Err{Message: "invalid taxYear: " + param})
+		}
+	}
+	data, err := load(taxYear)
+	if err != nil {
+		return LoadError(c, taxYear, err)
+	}
+	points, err := CurveCalculate(data, from, to, step)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, handler.ResponseCurve{TaxYear: taxYear, Points: points})
+}
+
+func curveRange(c echo.Context) (from, to, step handler.Money, err error) {
+	parse := func(name string, required bool) (handler.Money, error) {
+		param := c.QueryParam(name)
+		if param == "" {
+			if required {
+				return 0, fmt.Errorf("%s is required", name)
+			}
+			return 0, nil
+		}
+		amount, err := handler.ParseMoney(param)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %v", name, param)
+		}
+		if amount < 0 {
+			return 0, fmt.Errorf("%s must not be negative", name)
+		}
+		return amount, nil
+	}
+	if from, err = parse("from", false); err != nil {
+		return
+	}
+	if to, err = parse("to", true); err != nil {
+		return
+	}
+	if step, err = parse("step", true); err != nil {
+		return
+	}
+	if to > unlimited {
+		err = fmt.Errorf("to must not be greater than %v", unlimited)
+	} else if to < from {
+		err = fmt.Errorf("to must not be lower than from")
+	} else if step == 0 {
+		err = fmt.Errorf("step must be greater than 0")
+	} else if (to-from)/step >= MaxCurvePoints {
+		err = fmt.Errorf("at most %d points are allowed", MaxCurvePoints)
+	}
+	return
+}
+
+// CurveCalculate runs the full calculation at every step from from to to.
+// It counts points rather than adding step to the income, so a to close
+// to handler.MaxMoney cannot overflow.
+func CurveCalculate(data database.DataStruct, from, to, step handler.Money) ([]handler.CurvePoint, error) {
+	var points []handler.CurvePoint
+	for i := handler.Money(0); i <= (to-from)/step; i++ {
+		income := from + i*step
+		result, err := Compute(data, handler.RequestCalculation{TotalIncome: income}, nil)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, handler.CurvePoint{
+			TotalIncome:   income,
+			Tax:           TaxDue(result),
+			EffectiveRate: result.EffectiveRate,
+			MarginalRate:  result.MarginalRate,
+		})
+	}
+	return points, nil
+}
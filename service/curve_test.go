@@ -0,0 +1,66 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+func TestCurveCalculate(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	t.Run("should compute the tax at every step", func(t *testing.T) {
+		got, err := CurveCalculate(data, handler.Baht(0), handler.Baht(1000000), handler.Baht(500000))
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		want := []handler.CurvePoint{
+			{TotalIncome: handler.Baht(0)},
+			{TotalIncome: handler.Baht(500000), Tax: handler.Baht(29000), EffectiveRate: 0.058, MarginalRate: 0.1},
+			{TotalIncome: handler.Baht(1000000), Tax: handler.Baht(101000), EffectiveRate: 0.101, MarginalRate: 0.15},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+	t.Run("should stop at to near the largest amount", func(t *testing.T) {
+		got, err := CurveCalculate(data, handler.MaxMoney-50, handler.MaxMoney, 100)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if len(got) != 1 || got[0].TotalIncome != handler.MaxMoney-50 {
+			t.Errorf("expected one point at %v but got %v", handler.MaxMoney-50, got)
+		}
+	})
+}
+
+func TestTaxCurve(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Brackets:          database.DefaultBrackets(),
+	}
+	for _, query := range []string{"to=1000", "from=10&to=5&step=1", "to=1000&step=0", "to=100000&step=1", "to=abc&step=1", "from=1000000001&to=1000000001&step=1"} {
+		t.Run("should return status 400 for "+query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/tax/curve?"+query, nil)
+			res := httptest.NewRecorder()
+			c := echo.New().NewContext(req, res)
+
+			TaxCurve(c, loadData(data))
+
+			if res.Result().StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %v but got status %v", http.StatusBadRequest, res.Result().StatusCode)
+			}
+		})
+	}
+}
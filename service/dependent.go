@@ -0,0 +1,121 @@
+package service
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+// Allowance names of a handler.DependentAllowance.
+const (
+	DependentSpouse   = "spouse"
+	DependentChild    = "child"
+	DependentParent   = "parent"
+	DependentDisabled = "disabled"
+)
+
+// ValidateDependents checks every dependent and returns one error per
+// offending field. At most one spouse and four parents, the taxpayer's and
+// the spouse's, may be claimed.
+func ValidateDependents(dependents []handler.Dependent, taxYear int) []handler.ValidationErr {
+	var errs []handler.ValidationErr
+	count := map[string]int{}
+	for i, d := range dependents {
+		switch d.Relationship {
+		case handler.RelationshipSpouse, handler.RelationshipChild, handler.RelationshipParent, handler.RelationshipOther:
+			count[d.Relationship]++
+		default:
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "relationship", Reason: fmt.Sprintf("unsupported relationship %q", d.Relationship)})
+		}
+		if d.Relationship == handler.RelationshipSpouse && count[d.Relationship] > 1 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "relationship", Reason: "only one spouse may be claimed"})
+		}
+		if d.Relationship == handler.RelationshipParent && count[d.Relationship] > 4 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "relationship", Reason: "at most four parents may be claimed"})
+		}
+		needsBirthYear := d.Relationship == handler.RelationshipChild || d.Relationship == handler.RelationshipParent
+		if needsBirthYear && d.BirthYear == 0 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "birthYear", Reason: "birthYear is required"})
+		} else if d.BirthYear < 0 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "birthYear", Reason: "birthYear must be positive"})
+		} else if d.BirthYear > taxYear {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "birthYear", Reason: fmt.Sprintf("birthYear must not be after taxYear %d", taxYear)})
+		}
+	}
+	return errs
+}
+
+// ApplyDependents evaluates the eligibility of every dependent for the tax
+// year. Children are counted in order of birth, so only a second or later
+// child born in rules.ChildBonusFromYear or later earns rules.ChildBonus.
+// A child qualifies under 20, or under 25 while studying, or at any age
+// when disabled.
+func ApplyDependents(rules handler.DependentRules, taxYear int, dependents []handler.Dependent) []handler.DependentAllowance {
+	var children []int
+	for i, d := range dependents {
+		if d.Relationship == handler.RelationshipChild {
+			children = append(children, i)
+		}
+	}
+	slices.SortStableFunc(children, func(a, b int) int {
+		return cmp.Compare(dependents[a].BirthYear, dependents[b].BirthYear)
+	})
+	childOrder := map[int]int{}
+	for order, i := range children {
+		childOrder[i] = order + 1
+	}
+
+	var results []handler.DependentAllowance
+	for i, d := range dependents {
+		age := taxYear - d.BirthYear
+		switch d.Relationship {
+		case handler.RelationshipSpouse:
+			results = append(results, dependentAllowance(i, DependentSpouse, rules.Spouse, d.HasIncome, "spouse has income"))
+		case handler.RelationshipChild:
+			amount := rules.Child
+			if childOrder[i] >= 2 && d.BirthYear >= rules.ChildBonusFromYear {
+				amount = rules.ChildBonus
+			}
+			if !d.Disabled && (age >= 25 || (age >= 20 && !d.Studying)) {
+				results = append(results, handler.DependentAllowance{Index: i, Allowance: DependentChild, Reason: "child is 20 or older and not studying, or 25 or older"})
+				break
+			}
+			results = append(results, dependentAllowance(i, DependentChild, amount, d.HasIncome, "child has income"))
+		case handler.RelationshipParent:
+			if age < rules.ParentMinAge {
+				results = append(results, handler.DependentAllowance{Index: i, Allowance: DependentParent, Reason: fmt.Sprintf("parent is under %d", rules.ParentMinAge)})
+				break
+			}
+			results = append(results, dependentAllowance(i, DependentParent, rules.Parent, d.HasIncome, "parent has income"))
+		}
+		if d.Disabled {
+			results = append(results, dependentAllowance(i, DependentDisabled, rules.Disabled, d.HasIncome, "disabled dependent has income"))
+		} else if d.Relationship == handler.RelationshipOther {
+			results = append(results, handler.DependentAllowance{Index: i, Allowance: DependentDisabled, Reason: "only disabled dependents qualify"})
+		}
+	}
+	return results
+}
+
+func dependentAllowance(index int, allowance string, amount handler.Money, hasIncome bool, reason string) handler.DependentAllowance {
+	if hasIncome {
+		return handler.DependentAllowance{Index: index, Allowance: allowance, Reason: reason}
+	}
+	return handler.DependentAllowance{Index: index, Allowance: allowance, Amount: amount}
+}
+
+// DependentCalculate returns the family allowances of a request, itemised
+// per dependent, and their total.
+func DependentCalculate(data database.DataStruct, request handler.RequestCalculation, trace *Trace) ([]handler.DependentAllowance, handler.Money) {
+	taxYear := database.TaxYearOrDefault(data.TaxYear)
+	allowances := ApplyDependents(data.Dependents, taxYear, request.Dependents)
+	var total handler.Money
+	for _, a := range allowances {
+		total += a.Amount
+		trace.Add(handler.TraceStep{Step: "dependent", Name: fmt.Sprintf("%s #%d", a.Allowance, a.Index), Amount: a.Amount, Note: a.Reason})
+	}
+	return allowances, total
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+func TestApplyDependents(t *testing.T) {
+	rules := database.DefaultDependentRules()
+	t.Run("should give the bonus from the second child born in 2561", func(t *testing.T) {
+		got := ApplyDependents(rules, 2567, []handler.Dependent{
+			{Relationship: handler.RelationshipChild, BirthYear: 2563},
+			{Relationship: handler.RelationshipChild, BirthYear: 2558},
+			{Relationship: handler.RelationshipChild, BirthYear: 2560},
+		})
+
+		want := []handler.DependentAllowance{
+			{Index: 0, Allowance: DependentChild, Amount: handler.Baht(60000)},
+			{Index: 1, Allowance: DependentChild, Amount: handler.Baht(30000)},
+			{Index: 2, Allowance: DependentChild, Amount: handler.Baht(30000)},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+	t.Run("should check age and income", func(t *testing.T) {
+		got := ApplyDependents(rules, 2567, []handler.Dependent{
+			{Relationship: handler.RelationshipSpouse, HasIncome: true},
+			{Relationship: handler.RelationshipChild, BirthYear: 2545},
+			{Relationship: handler.RelationshipChild, BirthYear: 2545, Studying: true},
+			{Relationship: handler.RelationshipParent, BirthYear: 2510},
+			{Relationship: handler.RelationshipParent, BirthYear: 2500},
+		})
+
+		want := []handler.DependentAllowance{
+			{Index: 0, Allowance: DependentSpouse, Reason: "spouse has income"},
+			{Index: 1, Allowance: DependentChild, Reason: "child is 20 or older and not studying, or 25 or older"},
+			{Index: 2, Allowance: DependentChild, Amount: handler.Baht(30000)},
+			{Index: 3, Allowance: DependentParent, Reason: "parent is under 60"},
+			{Index: 4, Allowance: DependentParent, Amount: handler.Baht(30000)},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+	t.Run("should add the disabled allowance", func(t *testing.T) {
+		got := ApplyDependents(rules, 2567, []handler.Dependent{
+			{Relationship: handler.RelationshipParent, BirthYear: 2500, Disabled: true},
+			{Relationship: handler.RelationshipOther, Disabled: true},
+		})
+
+		want := []handler.DependentAllowance{
+			{Index: 0, Allowance: DependentParent, Amount: handler.Baht(30000)},
+			{Index: 0, Allowance: DependentDisabled, Amount: handler.Baht(60000)},
+			{Index: 1, Allowance: DependentDisabled, Amount: handler.Baht(60000)},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+}
+
+func TestValidateDependents(t *testing.T) {
+	t.Run("should accept valid dependents", func(t *testing.T) {
+		got := ValidateDependents([]handler.Dependent{
+			{Relationship: handler.RelationshipSpouse},
+			{Relationship: handler.RelationshipChild, BirthYear: 2560},
+		}, 2567)
+
+		if len(got) != 0 {
+			t.Errorf("expected no errors but got %v", got)
+		}
+	})
+	t.Run("should reject a second spouse and missing birthYear", func(t *testing.T) {
+		got := ValidateDependents([]handler.Dependent{
+			{Relationship: handler.RelationshipSpouse},
+			{Relationship: handler.RelationshipSpouse},
+			{Relationship: handler.RelationshipChild},
+		}, 2567)
+
+		want := []handler.ValidationErr{
+			{Index: 1, Field: "relationship", Reason: "only one spouse may be claimed"},
+			{Index: 2, Field: "birthYear", Reason: "birthYear is required"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+	t.Run("should reject a negative birthYear", func(t *testing.T) {
+		got := ValidateDependents([]handler.Dependent{{Relationship: handler.RelationshipChild, BirthYear: -2560}}, 2567)
+
+		want := []handler.ValidationErr{{Index: 0, Field: "birthYear", Reason: "birthYear must be positive"}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+}
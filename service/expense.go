@@ -0,0 +1,84 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+// ExpenseResult is the expense deducted from the income of one category,
+// or of a group of categories that share a cap.
+type ExpenseResult struct {
+	Name       string
+	Income     handler.Money
+	Deductible handler.Money
+	Rule       handler.ExpenseRule
+	Actual     bool
+}
+
+// ApplyExpenses deducts the expenses of every income category that has a
+// rule. Incomes of the same group are added together before the rate and
+// cap apply. Actual expenses replace the flat rate when the rule allows it
+// and the taxpayer claims them, but never exceed the income.
+func ApplyExpenses(rules []handler.ExpenseRule, incomes []handler.IncomeArr) []ExpenseResult {
+	keys := map[string]string{}
+	for _, rule := range rules {
+		keys[rule.Category] = rule.Category
+		if rule.Group != "" {
+			keys[rule.Category] = rule.Group
+		}
+	}
+	income := map[string]handler.Money{}
+	actual := map[string]handler.Money{}
+	for _, i := range incomes {
+		if key, ok := keys[i.Category]; ok {
+			income[key] += i.Amount
+			actual[key] += i.ActualExpense
+		}
+	}
+
+	var results []ExpenseResult
+	done := map[string]bool{}
+	for _, rule := range rules {
+		key := keys[rule.Category]
+		if _, ok := income[key]; !ok || done[key] {
+			continue
+		}
+		done[key] = true
+		result := ExpenseResult{Name: key, Income: income[key], Rule: rule}
+		if rule.Actual && actual[key] > 0 {
+			result.Deductible, result.Actual = min(actual[key], income[key]), true
+		} else {
+			result.Deductible = income[key].MulRate(rule.Rate)
+			if rule.Amount > 0 {
+				result.Deductible = min(result.Deductible, rule.Amount)
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// ExpenseCalculate returns the total expense deduction of the incomes of a
+// request. Income sent only as a flat totalIncome has no category and so
+// no expense deduction.
+func ExpenseCalculate(data database.DataStruct, incomes []handler.IncomeArr, trace *Trace) handler.Money {
+	var expense handler.Money
+	for _, e := range ApplyExpenses(data.Expenses, incomes) {
+		expense += e.Deductible
+		trace.Add(handler.TraceStep{Step: "expense", Name: e.Name, Requested: traceMoney(e.Income), Amount: e.Deductible, Note: expenseNote(e)})
+	}
+	return expense
+}
+
+func expenseNote(e ExpenseResult) string {
+	if e.Actual {
+		return "actual expenses"
+	}
+	note := fmt.Sprintf("%s of %s", FormatRate(e.Rule.Rate), FormatAmount(e.Income))
+	if e.Rule.Amount > 0 && e.Deductible == e.Rule.Amount {
+		note += fmt.Sprintf(", capped at %s", FormatAmount(e.Rule.Amount))
+	}
+	return note
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+func TestApplyExpenses(t *testing.T) {
+	rules := database.DefaultExpenseRules()
+	t.Run("should share the cap of 40(1) and 40(2)", func(t *testing.T) {
+		got := ApplyExpenses(rules, []handler.IncomeArr{
+			{Category: "40(1)", Amount: handler.Baht(150000)},
+			{Category: "40(2)", Amount: handler.Baht(100000)},
+		})
+
+		if len(got) != 1 || got[0].Name != "employment" || got[0].Deductible != handler.Baht(100000) {
+			t.Errorf("expected one employment expense of 100000 but got %+v", got)
+		}
+	})
+	t.Run("should deduct flat rate without cap", func(t *testing.T) {
+		got := ApplyExpenses(rules, []handler.IncomeArr{
+			{Category: "40(8)", Amount: handler.Baht(300000)},
+		})
+
+		if len(got) != 1 || got[0].Deductible != handler.Baht(180000) {
+			t.Errorf("expected expense of 180000 but got %+v", got)
+		}
+	})
+	t.Run("should use actual expenses when allowed", func(t *testing.T) {
+		got := ApplyExpenses(rules, []handler.IncomeArr{
+			{Category: "40(5)", Amount: handler.Baht(100000), ActualExpense: handler.Baht(45000)},
+			{Category: "40(1)", Amount: handler.Baht(100000), ActualExpense: handler.Baht(90000)},
+		})
+
+		if len(got) != 2 || got[0].Deductible != handler.Baht(50000) || got[1].Deductible != handler.Baht(45000) || !got[1].Actual {
+			t.Errorf("expected 50000 flat and 45000 actual but got %+v", got)
+		}
+	})
+	t.Run("should not deduct expenses without incomes", func(t *testing.T) {
+		got := ApplyExpenses(rules, nil)
+
+		if len(got) != 0 {
+			t.Errorf("expected no expenses but got %+v", got)
+		}
+	})
+}
+
+func TestExpenseCalculate(t *testing.T) {
+	data := database.DataStruct{Expenses: database.DefaultExpenseRules()}
+
+	got := ExpenseCalculate(data, []handler.IncomeArr{
+		{Category: "40(1)", Amount: handler.Baht(400000)},
+		{Category: "40(8)", Amount: handler.Baht(100000)},
+	}, nil)
+
+	if got != handler.Baht(160000) {
+		t.Errorf("expected %v but got %v", handler.Baht(160000), got)
+	}
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+// ValidateIncomes checks every income source and returns one error per
+// offending field. Withholding is checked against the income it was
+// withheld from.
+func ValidateIncomes(incomes []handler.IncomeArr) []handler.ValidationErr {
+	var errs []handler.ValidationErr
+	for i, income := range incomes {
+		if !slices.Contains(handler.IncomeCategories, income.Category) {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "category", Reason: fmt.Sprintf("unsupported category %q", income.Category)})
+		}
+		if income.ActualExpense < 0 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "actualExpense", Reason: "actualExpense must not be negative"})
+		}
+		if income.Amount < 0 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "amount", Reason: "amount must not be negative"})
+		} else if ValidateWht(income.Wht, income.Amount) == -1 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "wht", Reason: "wht must be between 0 and amount"})
+		}
+	}
+	return errs
+}
+
+// ResolveIncomes derives totalIncome and wht from the incomes of a request.
+// Requests without incomes keep the flat fields. Flat fields sent together
+// with incomes must be 0 or agree with the sums.
+func ResolveIncomes(request *handler.RequestCalculation) error {
+	if len(request.Incomes) == 0 {
+		return nil
+	}
+	var totalIncome, wht handler.Money
+	for _, income := range request.Incomes {
+		totalIncome += income.Amount
+		wht += income.Wht
+	}
+	if request.TotalIncome != 0 && request.TotalIncome != totalIncome {
+		return fmt.Errorf("totalIncome %v does not match incomes %v", request.TotalIncome, totalIncome)
+	}
+	if request.Wht != 0 && request.Wht != wht {
+		return fmt.Errorf("wht %v does not match incomes %v", request.Wht, wht)
+	}
+	request.TotalIncome, request.Wht = totalIncome, wht
+	return nil
+}
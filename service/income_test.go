@@ -0,0 +1,69 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+func TestValidateIncomes(t *testing.T) {
+	t.Run("should accept valid incomes", func(t *testing.T) {
+		got := ValidateIncomes([]handler.IncomeArr{
+			{Payer: "employer", Category: "40(1)", Amount: handler.Baht(400000), Wht: handler.Baht(10000)},
+			{Payer: "client", Category: "40(8)", Amount: handler.Baht(100000), Wht: handler.Baht(3000)},
+		})
+
+		if len(got) != 0 {
+			t.Errorf("expected no errors but got %v", got)
+		}
+	})
+	t.Run("should check wht per income", func(t *testing.T) {
+		got := ValidateIncomes([]handler.IncomeArr{
+			{Payer: "employer", Category: "40(1)", Amount: handler.Baht(400000), Wht: handler.Baht(10000)},
+			{Payer: "client", Category: "40(9)", Amount: handler.Baht(1000), Wht: handler.Baht(3000)},
+		})
+
+		want := []handler.ValidationErr{
+			{Index: 1, Field: "category", Reason: `unsupported category "40(9)"`},
+			{Index: 1, Field: "wht", Reason: "wht must be between 0 and amount"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+}
+
+func TestResolveIncomes(t *testing.T) {
+	incomes := []handler.IncomeArr{
+		{Payer: "employer", Category: "40(1)", Amount: handler.Baht(400000), Wht: handler.Baht(10000)},
+		{Payer: "client", Category: "40(8)", Amount: handler.Baht(100000), Wht: handler.Baht(3000)},
+	}
+	t.Run("should derive totalIncome and wht", func(t *testing.T) {
+		request := handler.RequestCalculation{Incomes: incomes}
+
+		err := ResolveIncomes(&request)
+
+		if err != nil || request.TotalIncome != handler.Baht(500000) || request.Wht != handler.Baht(13000) {
+			t.Errorf("expected 500000 and 13000 but got %v and %v (%v)", request.TotalIncome, request.Wht, err)
+		}
+	})
+	t.Run("should keep flat fields without incomes", func(t *testing.T) {
+		request := handler.RequestCalculation{TotalIncome: handler.Baht(500000), Wht: handler.Baht(1000)}
+
+		err := ResolveIncomes(&request)
+
+		if err != nil || request.TotalIncome != handler.Baht(500000) || request.Wht != handler.Baht(1000) {
+			t.Errorf("expected 500000 and 1000 but got %v and %v (%v)", request.TotalIncome, request.Wht, err)
+		}
+	})
+	t.Run("should reject flat fields that disagree", func(t *testing.T) {
+		request := handler.RequestCalculation{TotalIncome: handler.Baht(400000), Incomes: incomes}
+
+		err := ResolveIncomes(&request)
+
+		if err == nil {
+			t.Errorf("expected error but got nil")
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"fmt"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+// GrossIncome returns the income of the categories the minimum tax applies
+// to, 40(2) to 40(8). Salary under 40(1) and income sent only as a flat
+// totalIncome are not counted.
+func GrossIncome(incomes []handler.IncomeArr) handler.Money {
+	var gross handler.Money
+	for _, income := range incomes {
+		if income.Category != "40(1)" {
+			gross += income.Amount
+		}
+	}
+	return gross
+}
+
+// GrossIncomeTaxCalculate returns the minimum tax on gross income, or 0
+// when the income is below the threshold or the minimum tax is off.
+func GrossIncomeTaxCalculate(minimum handler.MinimumTax, incomes []handler.IncomeArr, trace *Trace) handler.Money {
+	gross := GrossIncome(incomes)
+	if minimum.Rate == 0 || gross < minimum.Threshold || gross == 0 {
+		return 0
+	}
+	tax := gross.MulRate(minimum.Rate)
+	trace.Add(handler.TraceStep{Step: "grossIncomeTax", Amount: gross, Rate: traceRate(minimum.Rate), Tax: traceMoney(tax),
+		Note: fmt.Sprintf("40(2) to 40(8) income is at least %s", FormatAmount(minimum.Threshold))})
+	return tax
+}
+
+// TaxMethod applies the higher of the progressive tax and the minimum tax.
+// The progressive method wins a tie.
+func TaxMethod(progressiveTax, grossIncomeTax handler.Money) (string, handler.Money) {
+	if grossIncomeTax > progressiveTax {
+		return handler.TaxMethodGrossIncome, grossIncomeTax
+	}
+	return handler.TaxMethodProgressive, progressiveTax
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+func TestGrossIncomeTaxCalculate(t *testing.T) {
+	minimum := database.DefaultMinimumTax()
+	t.Run("should tax 0.5% of gross income", func(t *testing.T) {
+		got := GrossIncomeTaxCalculate(minimum, []handler.IncomeArr{
+			{Category: "40(1)", Amount: handler.Baht(500000)},
+			{Category: "40(8)", Amount: handler.Baht(200000)},
+		}, nil)
+
+		if got != handler.Baht(1000) {
+			t.Errorf("expected %v but got %v", handler.Baht(1000), got)
+		}
+	})
+	t.Run("should return 0 below the threshold", func(t *testing.T) {
+		got := GrossIncomeTaxCalculate(minimum, []handler.IncomeArr{
+			{Category: "40(1)", Amount: handler.Baht(500000)},
+			{Category: "40(2)", Amount: handler.Baht(119999)},
+		}, nil)
+
+		if got != 0 {
+			t.Errorf("expected %v but got %v", 0, got)
+		}
+	})
+}
+
+func TestTaxMethod(t *testing.T) {
+	t.Run("should pick gross income tax when higher", func(t *testing.T) {
+		method, tax := TaxMethod(handler.Baht(500), handler.Baht(1000))
+
+		if method != handler.TaxMethodGrossIncome || tax != handler.Baht(1000) {
+			t.Errorf("expected %v %v but got %v %v", handler.TaxMethodGrossIncome, handler.Baht(1000), method, tax)
+		}
+	})
+	t.Run("should pick progressive tax on a tie", func(t *testing.T) {
+		method, tax := TaxMethod(handler.Baht(1000), handler.Baht(1000))
+
+		if method != handler.TaxMethodProgressive || tax != handler.Baht(1000) {
+			t.Errorf("expected %v %v but got %v %v", handler.TaxMethodProgressive, handler.Baht(1000), method, tax)
+		}
+	})
+}
+
+func TestComputeMinimumTax(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Expenses:          database.DefaultExpenseRules(),
+		MinimumTax:        database.DefaultMinimumTax(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	request := handler.RequestCalculation{
+		TotalIncome: handler.Baht(400000),
+		Wht:         handler.Baht(500),
+		Incomes:     []handler.IncomeArr{{Category: "40(8)", Amount: handler.Baht(400000), Wht: handler.Baht(500)}},
+	}
+
+	got, err := Compute(data, request, nil)
+
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got.TaxMethod != handler.TaxMethodGrossIncome || got.ProgressiveTax != 0 || got.GrossIncomeTax != handler.Baht(2000) || got.Tax != handler.Baht(1500) {
+		t.Errorf("expected gross income tax 2000 less wht 500 but got %+v", got)
+	}
+}
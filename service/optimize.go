@@ -0,0 +1,157 @@
+package service
+
+import (
+	"cmp"
+	"math"
+	"net/http"
+	"slices"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+// OptimizeTypes are the allowance types the advisor suggests topping up.
+var OptimizeTypes = []string{"rmf", "ssf", "thai-esg", "k-receipt", "donation"}
+
+// unlimited is a claim large enough to reach every cap.
+var unlimited = handler.Baht(1000000000)
+
+func Optimize(c echo.Context, load database.Loader) error {
+	var request handler.RequestOptimize
+	if err := c.Bind(&request); err != nil {
+		return err
+	}
+	if request.Budget < 0 {
+		return c.JSON(http.StatusBadRequest, Err{Message: "Invalid budget"})
+	}
+	data, ok, err := PrepareRequest(c, load, &request.RequestCalculation)
+	if !ok {
+		return err
+	}
+	response, err := OptimizeCalculate(data, request.RequestCalculation, request.Budget)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// OptimizeCalculate reports the room left under the caps of every
+// OptimizeTypes rule and plans a budget across them. The plan fills the
+// rules that deduct the most per baht first, in registry order on a tie,
+// and checks the room again after every step because rules share caps.
+// Every option assumes the other claims stay as requested.
+func OptimizeCalculate(data database.DataStruct, request handler.RequestCalculation, budget handler.Money) (handler.ResponseOptimize, error) {
+	base, err := Compute(data, request, nil)
+	if err != nil {
+		return handler.ResponseOptimize{}, err
+	}
+	response := handler.ResponseOptimize{Tax: TaxDue(base), MarginalRate: base.MarginalRate}
+
+	var rules []handler.AllowanceRule
+	for _, rule := range data.Allowances {
+		if slices.Contains(OptimizeTypes, rule.AllowanceType) {
+			rules = append(rules, rule)
+		}
+	}
+	for _, rule := range rules {
+		option := handler.OptimizeOption{AllowanceType: rule.AllowanceType, Subtype: rule.Subtype, TaxSavedPerBaht: response.MarginalRate * rule.MultiplierOrOne()}
+		option.Room = AllowanceRoom(data, request, rule)
+		if option.Room > 0 {
+			topped, err := Compute(data, withAllowance(request, rule, option.Room), nil)
+			if err != nil {
+				return handler.ResponseOptimize{}, err
+			}
+			option.TaxSaved = response.Tax - TaxDue(topped)
+		}
+		response.Options = append(response.Options, option)
+	}
+
+	slices.SortStableFunc(rules, func(a, b handler.AllowanceRule) int {
+		return cmp.Compare(b.MultiplierOrOne(), a.MultiplierOrOne())
+	})
+	// A later step can shrink the room of an earlier one, e.g. k-receipt
+	// lowers the net income donations are capped by. Trim such steps to
+	// what they still deduct and plan again with the budget freed.
+	limits := map[string]handler.Money{}
+	var plan handler.RequestCalculation
+	for range rules {
+		plan, response.Plan = PlanBudget(data, request, rules, budget, limits)
+		trimmed := false
+		for _, rule := range rules {
+			planned, claimed := claimedAmount(response.Plan, rule), deductible(data, request, rule)
+			used := handler.Money(math.Ceil(float64(deductible(data, plan, rule)-claimed) / rule.MultiplierOrOne()))
+			if used < planned {
+				limits[rule.Key()], trimmed = used, true
+			}
+		}
+		if !trimmed {
+			break
+		}
+	}
+	planned, err := Compute(data, plan, nil)
+	if err != nil {
+		return handler.ResponseOptimize{}, err
+	}
+	response.PlanTax = TaxDue(planned)
+	response.PlanTaxSaved = response.Tax - response.PlanTax
+	return response, nil
+}
+
+// PlanBudget spends budget on rules in order, each up to its room and its
+// limit when it has one.
+func PlanBudget(data database.DataStruct, request handler.RequestCalculation, rules []handler.AllowanceRule, budget handler.Money, limits map[string]handler.Money) (handler.RequestCalculation, []handler.AllowancesArr) {
+	steps := []handler.AllowancesArr{}
+	for _, rule := range rules {
+		amount := min(AllowanceRoom(data, request, rule), budget)
+		if limit, ok := limits[rule.Key()]; ok {
+			amount = min(amount, limit)
+		}
+		if amount <= 0 {
+			continue
+		}
+		budget -= amount
+		request = withAllowance(request, rule, amount)
+		steps = append(steps, handler.AllowancesArr{AllowanceType: rule.AllowanceType, Subtype: rule.Subtype, Amount: amount})
+	}
+	return request, steps
+}
+
+func claimedAmount(steps []handler.AllowancesArr, rule handler.AllowanceRule) handler.Money {
+	for _, step := range steps {
+		if step.Key() == rule.Key() {
+			return step.Amount
+		}
+	}
+	return 0
+}
+
+// TaxDue is the tax of a calculation before withholding is offset.
+func TaxDue(response handler.ResponseCalculation) handler.Money {
+	return max(response.ProgressiveTax, response.GrossIncomeTax)
+}
+
+// AllowanceRoom returns how much more can be claimed under rule before its
+// own cap or its group's stops the deduction from growing.
+func AllowanceRoom(data database.DataStruct, request handler.RequestCalculation, rule handler.AllowanceRule) handler.Money {
+	current := deductible(data, request, rule)
+	most := deductible(data, withAllowance(request, rule, unlimited), rule)
+	room := float64(most-current) / rule.MultiplierOrOne()
+	return handler.Money(math.Ceil(room))
+}
+
+func deductible(data database.DataStruct, request handler.RequestCalculation, rule handler.AllowanceRule) handler.Money {
+	expense := ExpenseCalculate(data, request.Incomes, nil)
+	_, family := DependentCalculate(data, request, nil)
+	for _, a := range ApplyAllowances(data, request.TotalIncome, expense+family, request.Allowances) {
+		if a.AllowanceType == rule.AllowanceType && a.Subtype == rule.Subtype {
+			return a.Deductible
+		}
+	}
+	return 0
+}
+
+func withAllowance(request handler.RequestCalculation, rule handler.AllowanceRule, amount handler.Money) handler.RequestCalculation {
+	request.Allowances = append(slices.Clone(request.Allowances), handler.AllowancesArr{AllowanceType: rule.AllowanceType, Subtype: rule.Subtype, Amount: amount})
+	return request
+}
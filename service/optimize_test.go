@@ -0,0 +1,67 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+func TestOptimizeCalculate(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	request := handler.RequestCalculation{
+		TotalIncome: handler.Baht(1000000),
+		Allowances:  []handler.AllowancesArr{{AllowanceType: "rmf", Amount: handler.Baht(100000)}},
+	}
+	t.Run("should report the room left under every cap", func(t *testing.T) {
+		got, err := OptimizeCalculate(data, request, 0)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got.Tax != handler.Baht(86000) || got.MarginalRate != 0.15 {
+			t.Errorf("expected tax 86000 at 15%% but got %v at %v", got.Tax, got.MarginalRate)
+		}
+		room := map[string]handler.Money{}
+		for _, option := range got.Options {
+			room[handler.AllowancesArr{AllowanceType: option.AllowanceType, Subtype: option.Subtype}.Key()] = option.Room
+		}
+		want := map[string]handler.Money{
+			"rmf":                handler.Baht(200000),
+			"ssf":                handler.Baht(200000),
+			"thai-esg":           handler.Baht(300000),
+			"k-receipt":          handler.Baht(50000),
+			"donation":           handler.Baht(84000),
+			"donation/education": handler.Baht(42000),
+			"donation/political": handler.Baht(10000),
+		}
+		for key, amount := range want {
+			if room[key] != amount {
+				t.Errorf("expected room %v for %v but got %v", amount, key, room[key])
+			}
+		}
+	})
+	t.Run("should spend the budget where it deducts the most", func(t *testing.T) {
+		got, err := OptimizeCalculate(data, request, handler.Baht(50000))
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		want := []handler.AllowancesArr{
+			{AllowanceType: "donation", Subtype: "education", Amount: handler.Money(4157895)},
+			{AllowanceType: "k-receipt", Amount: handler.Money(842105)},
+		}
+		if !reflect.DeepEqual(got.Plan, want) {
+			t.Errorf("expected %v but got %v", want, got.Plan)
+		}
+		if got.PlanTaxSaved <= 0 || got.PlanTax != got.Tax-got.PlanTaxSaved {
+			t.Errorf("expected a saving but got %+v", got)
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+func Withholding(c echo.Context, load database.Loader) error {
+	var request handler.RequestWithholding
+	if err := c.Bind(&request); err != nil {
+		return err
+	}
+	if errs := ValidatePayroll(request); len(errs) > 0 {
+		return c.JSON(http.StatusBadRequest, handler.ResponseValidation{Message: "Invalid payroll", Errors: errs})
+	}
+	annual := payrollRequest(request, MonthlyPay(request).Total())
+	data, ok, err := PrepareRequest(c, load, &annual)
+	if !ok {
+		return err
+	}
+	response, err := WithholdingCalculate(data, request)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// ValidatePayroll checks the salary, raises and bonuses of a request.
+// Allowances and dependents are checked like a calculation's.
+func ValidatePayroll(request handler.RequestWithholding) []handler.ValidationErr {
+	var errs []handler.ValidationErr
+	if request.Salary < 0 {
+		errs = append(errs, handler.ValidationErr{Field: "salary", Reason: "salary must not be negative"})
+	}
+	for i, raise := range request.Raises {
+		if raise.Month < 1 || raise.Month > 12 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "raises.month", Reason: "month must be between 1 and 12"})
+		}
+		if raise.Salary < 0 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "raises.salary", Reason: "salary must not be negative"})
+		}
+	}
+	for i, bonus := range request.Bonuses {
+		if bonus.Month < 1 || bonus.Month > 12 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "bonuses.month", Reason: "month must be between 1 and 12"})
+		}
+		if bonus.Amount < 0 {
+			errs = append(errs, handler.ValidationErr{Index: i, Field: "bonuses.amount", Reason: "amount must not be negative"})
+		}
+	}
+	return errs
+}
+
+// Pay is the salary and bonus paid in each month, January first.
+type Pay [12]struct{ Salary, Bonus handler.Money }
+
+func (p Pay) Total() handler.Money {
+	var total handler.Money
+	for _, month := range p {
+		total += month.Salary + month.Bonus
+	}
+	return total
+}
+
+// MonthlyPay spreads the salary, raises and bonuses of a request over the
+// year. A later raise replaces an earlier one from its month onwards.
+func MonthlyPay(request handler.RequestWithholding) Pay {
+	var pay Pay
+	for m := range pay {
+		pay[m].Salary = request.Salary
+		changed := 0
+		for _, raise := range request.Raises {
+			if raise.Month <= m+1 && raise.Month >= changed {
+				pay[m].Salary, changed = raise.Salary, raise.Month
+			}
+		}
+	}
+	for _, bonus := range request.Bonuses {
+		pay[bonus.Month-1].Bonus += bonus.Amount
+	}
+	return pay
+}
+
+// payrollRequest is the calculation of an annual salary income of amount.
+func payrollRequest(request handler.RequestWithholding, amount handler.Money) handler.RequestCalculation {
+	return handler.RequestCalculation{
+		TaxYear:     request.TaxYear,
+		TotalIncome: amount,
+		Incomes:     []handler.IncomeArr{{Category: "40(1)", Amount: amount}},
+		Allowances:  request.Allowances,
+		Dependents:  request.Dependents,
+	}
+}
+
+// WithholdingCalculate builds the monthly withholding schedule. Every month
+// projects the annual income as what was paid so far plus the current
+// salary for the rest of the year, and spreads the tax on it not yet
+// withheld evenly over the remaining months, dropping fractions of a
+// satang until the last month. A bonus is not projected ahead: the tax it
+// adds to the projection is withheld in full in the month it is paid. The
+// schedule therefore adds up to the tax on the actual annual income unless
+// an earlier projection withheld more.
+func WithholdingCalculate(data database.DataStruct, request handler.RequestWithholding) (handler.ResponseWithholding, error) {
+	taxOn := func(amount handler.Money) (handler.Money, error) {
+		result, err := Compute(data, payrollRequest(request, amount), nil)
+		return TaxDue(result), err
+	}
+	pay := MonthlyPay(request)
+	response := handler.ResponseWithholding{AnnualIncome: pay.Total()}
+	var paid handler.Money
+	for m, month := range pay {
+		remaining := handler.Money(12 - m)
+		projected := paid + month.Salary*remaining
+		tax, err := taxOn(projected)
+		if err != nil {
+			return response, err
+		}
+		withholding := max(tax-response.TotalWithheld, 0) / remaining
+		if month.Bonus > 0 {
+			withBonus, err := taxOn(projected + month.Bonus)
+			if err != nil {
+				return response, err
+			}
+			withholding += max(withBonus-tax, 0)
+			projected, tax = projected+month.Bonus, withBonus
+		}
+		response.Months = append(response.Months, handler.MonthlyWithholding{
+			Month:           m + 1,
+			Salary:          month.Salary,
+			Bonus:           month.Bonus,
+			ProjectedIncome: projected,
+			ProjectedTax:    tax,
+			Withholding:     withholding,
+		})
+		response.TotalWithheld += withholding
+		paid += month.Salary + month.Bonus
+	}
+	var err error
+	response.AnnualTax, err = taxOn(response.AnnualIncome)
+	return response, err
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+func TestWithholdingCalculate(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+		Expenses:          database.DefaultExpenseRules(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	t.Run("should spread the tax on a flat salary over the year", func(t *testing.T) {
+		request := handler.RequestWithholding{Salary: handler.Baht(50000)}
+
+		got, err := WithholdingCalculate(data, request)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got.AnnualIncome != handler.Baht(600000) || got.AnnualTax != handler.Baht(29000) || got.TotalWithheld != handler.Baht(29000) {
+			t.Errorf("expected 29000 withheld on 600000 but got %v withheld, tax %v on %v", got.TotalWithheld, got.AnnualTax, got.AnnualIncome)
+		}
+		if len(got.Months) != 12 || got.Months[0].Withholding != handler.Money(241666) {
+			t.Errorf("expected 2416.66 withheld in January but got %v", got.Months)
+		}
+	})
+	t.Run("should withhold the tax on a bonus in the month it is paid", func(t *testing.T) {
+		request := handler.RequestWithholding{
+			Salary:  handler.Baht(50000),
+			Bonuses: []handler.Bonus{{Month: 12, Amount: handler.Baht(100000)}},
+		}
+
+		got, err := WithholdingCalculate(data, request)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got.AnnualTax != handler.Baht(41000) || got.TotalWithheld != handler.Baht(41000) {
+			t.Errorf("expected 41000 withheld but got %v of %v", got.TotalWithheld, got.AnnualTax)
+		}
+		if len(got.Months) == 12 && got.Months[11].ProjectedIncome != handler.Baht(700000) {
+			t.Errorf("expected December to project 700000 but got %v", got.Months[11].ProjectedIncome)
+		}
+	})
+	t.Run("should project a raise from its month onwards", func(t *testing.T) {
+		request := handler.RequestWithholding{
+			Salary: handler.Baht(50000),
+			Raises: []handler.SalaryChange{{Month: 7, Salary: handler.Baht(60000)}},
+		}
+
+		got, err := WithholdingCalculate(data, request)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got.AnnualIncome != handler.Baht(660000) || got.TotalWithheld != handler.Baht(35000) {
+			t.Errorf("expected 35000 withheld on 660000 but got %v on %v", got.TotalWithheld, got.AnnualIncome)
+		}
+		if len(got.Months) == 12 && got.Months[6].ProjectedIncome != handler.Baht(660000) {
+			t.Errorf("expected July to project 660000 but got %v", got.Months[6].ProjectedIncome)
+		}
+	})
+}
+
+func TestValidatePayroll(t *testing.T) {
+	t.Run("should reject months outside the year", func(t *testing.T) {
+		request := handler.RequestWithholding{
+			Raises:  []handler.SalaryChange{{Month: 13}},
+			Bonuses: []handler.Bonus{{Month: 0, Amount: handler.Baht(-1)}},
+		}
+
+		got := ValidatePayroll(request)
+
+		if len(got) != 3 {
+			t.Errorf("expected 3 errors but got %v", got)
+		}
+	})
+}
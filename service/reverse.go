@@ -0,0 +1,136 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+)
+
+var (
+	ErrUnreachable = errors.New("target cannot be reached")
+	ErrUnbounded   = errors.New("target is not passed at any income")
+)
+
+func Reverse(c echo.Context, load database.Loader) error {
+	var request handler.RequestReverse
+	if err := c.Bind(&request); err != nil {
+		return err
+	}
+	switch request.Target {
+	case handler.TargetTax, handler.TargetNetIncome, handler.TargetRefund:
+	default:
+		return c.JSON(http.StatusBadRequest, Err{Message: "Invalid target"})
+	}
+	switch request.Bound {
+	case "":
+		request.Bound = handler.BoundLowest
+	case handler.BoundLowest, handler.BoundHighest:
+	default:
+		return c.JSON(http.StatusBadRequest, Err{Message: "Invalid bound"})
+	}
+	if request.Amount < 0 {
+		return c.JSON(http.StatusBadRequest, Err{Message: "Invalid amount"})
+	}
+	if len(request.Incomes) > 0 {
+		return c.JSON(http.StatusBadRequest, Err{Message: "incomes are not supported, use totalIncome"})
+	}
+	// Validate against the largest income searched, so wht only has to be
+	// non-negative here.
+	request.TotalIncome = unlimited
+	data, ok, err := PrepareRequest(c, load, &request.RequestCalculation)
+	if !ok {
+		return err
+	}
+	response, err := ReverseCalculate(data, request)
+	if errors.Is(err, ErrUnreachable) || errors.Is(err, ErrUnbounded) {
+		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// ReverseCalculate searches totalIncome for the target of request by
+// bisection over whole satang, running the full calculation at every step.
+// The tax never falls as income rises, so the tax payable after wht, the
+// net income and the negated refund all grow with income, and the result
+// is the lowest income at which the target is reached, or with
+// handler.BoundHighest the highest income before it is passed. Income never
+// goes below wht.
+func ReverseCalculate(data database.DataStruct, request handler.RequestReverse) (handler.ResponseReverse, error) {
+	calculate := func(income handler.Money) (handler.ResponseCalculation, error) {
+		r := request.RequestCalculation
+		r.TotalIncome = income
+		return Compute(data, r, nil)
+	}
+	target := request.Amount
+	value := func(result handler.ResponseCalculation, income handler.Money) handler.Money {
+		// The tax payable is negative while wht is refunded, so it
+		// serves both the tax and the negated refund.
+		switch request.Target {
+		case handler.TargetTax, handler.TargetRefund:
+			return TaxDue(result) - request.Wht
+		}
+		return income - TaxDue(result)
+	}
+	if request.Target == handler.TargetRefund {
+		target = -target
+	}
+	// Search the lowest income that reaches the target, or for the highest
+	// bound the lowest that passes it, which is one satang too many.
+	highest := request.Bound == handler.BoundHighest
+	reached := func(v handler.Money) bool {
+		if highest {
+			return v > target
+		}
+		return v >= target
+	}
+
+	low, high := request.Wht, unlimited
+	result, err := calculate(low)
+	if err != nil {
+		return handler.ResponseReverse{}, err
+	}
+	if v := value(result, low); reached(v) {
+		if highest || v != target {
+			return handler.ResponseReverse{}, ErrUnreachable
+		}
+		return reverseResponse(low, result), nil
+	}
+	if result, err = calculate(high); err != nil {
+		return handler.ResponseReverse{}, err
+	}
+	if !reached(value(result, high)) {
+		if highest {
+			return handler.ResponseReverse{}, ErrUnbounded
+		}
+		return handler.ResponseReverse{}, ErrUnreachable
+	}
+	// The target is reached at high but not at low.
+	for high-low > 1 {
+		mid := low + (high-low)/2
+		if result, err = calculate(mid); err != nil {
+			return handler.ResponseReverse{}, err
+		}
+		if reached(value(result, mid)) {
+			high = mid
+		} else {
+			low = mid
+		}
+	}
+	if highest {
+		high--
+	}
+	if result, err = calculate(high); err != nil {
+		return handler.ResponseReverse{}, err
+	}
+	return reverseResponse(high, result), nil
+}
+
+func reverseResponse(income handler.Money, result handler.ResponseCalculation) handler.ResponseReverse {
+	return handler.ResponseReverse{TotalIncome: income, NetIncome: income - TaxDue(result), Calculation: result}
+}
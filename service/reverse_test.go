@@ -0,0 +1,106 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+func TestReverseCalculate(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	t.Run("should find the income for a target tax", func(t *testing.T) {
+		request := handler.RequestReverse{Target: handler.TargetTax, Amount: handler.Baht(29000)}
+
+		got, err := ReverseCalculate(data, request)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got.TotalIncome != handler.Baht(500000) || got.Calculation.Tax != handler.Baht(29000) {
+			t.Errorf("expected income 500000 with tax 29000 but got %v with %v", got.TotalIncome, got.Calculation.Tax)
+		}
+	})
+	t.Run("should find the income for a target tax payable after wht", func(t *testing.T) {
+		request := handler.RequestReverse{
+			RequestCalculation: handler.RequestCalculation{Wht: handler.Baht(25000)},
+			Target:             handler.TargetTax,
+			Amount:             handler.Baht(4000),
+		}
+
+		got, err := ReverseCalculate(data, request)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got.TotalIncome != handler.Baht(500000) || got.Calculation.Tax != handler.Baht(4000) {
+			t.Errorf("expected income 500000 with tax 4000 but got %v with %v", got.TotalIncome, got.Calculation.Tax)
+		}
+	})
+	t.Run("should find the income for a target net income", func(t *testing.T) {
+		request := handler.RequestReverse{
+			RequestCalculation: handler.RequestCalculation{Allowances: []handler.AllowancesArr{{AllowanceType: "k-receipt", Amount: handler.Baht(50000)}}},
+			Target:             handler.TargetNetIncome,
+			Amount:             handler.Baht(476000),
+		}
+
+		got, err := ReverseCalculate(data, request)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		// The tax on 499999.99 truncates to 23999.99, one satang less than on
+		// 500000, so both leave a net income of 476000.
+		if got.TotalIncome != handler.Money(49999999) || got.NetIncome != handler.Baht(476000) {
+			t.Errorf("expected income 499999.99 with net 476000 but got %v with %v", got.TotalIncome, got.NetIncome)
+		}
+	})
+	t.Run("should find the income for a target refund", func(t *testing.T) {
+		request := handler.RequestReverse{
+			RequestCalculation: handler.RequestCalculation{Wht: handler.Baht(25000)},
+			Target:             handler.TargetRefund,
+			Amount:             handler.Baht(4000),
+		}
+
+		got, err := ReverseCalculate(data, request)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got.TotalIncome != handler.Baht(420000) || got.Calculation.TaxRefund != handler.Baht(4000) {
+			t.Errorf("expected income 420000 with refund 4000 but got %v with %v", got.TotalIncome, got.Calculation.TaxRefund)
+		}
+	})
+	t.Run("should find the highest income paying no tax", func(t *testing.T) {
+		request := handler.RequestReverse{Target: handler.TargetTax, Amount: 0, Bound: handler.BoundHighest}
+
+		got, err := ReverseCalculate(data, request)
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		// 5% of the 0.09 above 150000 taxable truncates to no tax.
+		if got.TotalIncome != handler.Money(21000009) || got.Calculation.Tax != 0 {
+			t.Errorf("expected income 210000.09 with tax 0 but got %v with %v", got.TotalIncome, got.Calculation.Tax)
+		}
+	})
+	t.Run("should reject a refund above wht", func(t *testing.T) {
+		request := handler.RequestReverse{
+			RequestCalculation: handler.RequestCalculation{Wht: handler.Baht(25000)},
+			Target:             handler.TargetRefund,
+			Amount:             handler.Baht(30000),
+		}
+
+		_, err := ReverseCalculate(data, request)
+
+		if !errors.Is(err, ErrUnreachable) {
+			t.Errorf("expected ErrUnreachable but got %v", err)
+		}
+	})
+}
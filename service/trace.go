@@ -0,0 +1,60 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
+)
+
+// Trace records the steps of a calculation for explain mode. The
+// calculation functions take a *Trace and a nil one records nothing, so the
+// trace always comes from the same code path as the result.
+type Trace struct {
+	Steps []handler.TraceStep
+}
+
+func (t *Trace) Add(step handler.TraceStep) {
+	if t != nil {
+		t.Steps = append(t.Steps, step)
+	}
+}
+
+func traceMoney(amount handler.Money) *handler.Money {
+	return &amount
+}
+
+func traceRate(rate float64) *float64 {
+	return &rate
+}
+
+// FormatRate renders a rate such as 0.3 as "30%".
+func FormatRate(rate float64) string {
+	return strconv.FormatFloat(rate*100, 'g', 6, 64) + "%"
+}
+
+func capNote(rule handler.AllowanceRule, result AllowanceResult) string {
+	if m := rule.MultiplierOrOne(); m != 1 {
+		return fmt.Sprintf("counted %vx, ", m) + capReason(rule, result)
+	}
+	return capReason(rule, result)
+}
+
+func capReason(rule handler.AllowanceRule, result AllowanceResult) string {
+	switch result.CappedBy {
+	case "":
+		return "within cap"
+	case handler.CapGroup:
+		return fmt.Sprintf("limited by the shared cap of group %s", rule.Group)
+	}
+	if rule.CapType != handler.CapFixed && rule.Amount > 0 && result.Deductible == rule.Amount {
+		return fmt.Sprintf("capped at %s", FormatAmount(rule.Amount))
+	}
+	switch result.CappedBy {
+	case handler.CapIncomePercent:
+		return fmt.Sprintf("capped at %s of income", FormatRate(rule.Rate))
+	case handler.CapNetIncomePercent:
+		return fmt.Sprintf("capped at %s of net income after other deductions", FormatRate(rule.Rate))
+	}
+	return fmt.Sprintf("capped at %s", FormatAmount(rule.Amount))
+}
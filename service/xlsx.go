@@ -0,0 +1,151 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/xuri/excelize/v2"
+)
+
+var ErrUnreadableSheet = errors.New("taxFile sheet cannot be read")
+
+// MIMEXlsx is the content type of an .xlsx workbook.
+const MIMEXlsx = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// xlsxUnzipRatio is how many times MaxBytes an uploaded workbook may take
+// unzipped. Sheet XML spends about five bytes for every byte of CSV.
+const xlsxUnzipRatio = 10
+
+// XlsxOptions opens uploaded workbooks within limits, so a small file that
+// unzips to far more than a CSV of MaxBytes is rejected before it fills
+// memory or disk.
+func XlsxOptions(limits CsvLimits) excelize.Options {
+	return excelize.Options{UnzipSizeLimit: limits.MaxBytes * xlsxUnzipRatio}
+}
+
+// groupedNumber matches a number typed as text with thousands separators.
+var groupedNumber = regexp.MustCompile(`^\s*-?\d{1,3}(,\d{3})+(\.\d+)?\s*$`)
+
+// xlsxReader reads the first sheet of a workbook as a RowReader. Cells
+// are read without their number format, so 500000 formatted as 500,000
+// reads 500000, and so does 500,000 typed as text. Blank rows are skipped
+// like blank lines of a CSV file but still counted, so the line of a row
+// is its row number in the sheet, and rows are padded to the width of the
+// header since trailing empty cells are not stored.
+type xlsxReader struct {
+	rows  *excelize.Rows
+	width int
+	line  int
+}
+
+// XlsxRows opens the first sheet of book for reading.
+func XlsxRows(book *excelize.File) (RowReader, error) {
+	sheets := book.GetSheetList()
+	if len(sheets) == 0 {
+		return nil, fmt.Errorf("%w: the workbook has no sheet", ErrUnreadableSheet)
+	}
+	rows, err := book.Rows(sheets[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnreadableSheet, err)
+	}
+	return &xlsxReader{rows: rows}, nil
+}
+
+func (r *xlsxReader) Read() ([]string, int, error) {
+	// Next visits every row number in turn, stored in the sheet or not.
+	for r.rows.Next() {
+		r.line++
+		record, err := r.rows.Columns(excelize.Options{RawCellValue: true})
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrUnreadableSheet, err)
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		if r.width == 0 {
+			r.width = len(record)
+		}
+		for len(record) < r.width {
+			record = append(record, "")
+		}
+		for i, cell := range record {
+			if groupedNumber.MatchString(cell) {
+				record[i] = strings.ReplaceAll(cell, ",", "")
+			}
+		}
+		return record, r.line, nil
+	}
+	if err := r.rows.Error(); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrUnreadableSheet, err)
+	}
+	if err := r.rows.Close(); err != nil {
+		return nil, 0, err
+	}
+	return nil, 0, io.EOF
+}
+
+// writeXlsx writes a workbook with a Results sheet of the taxes and an
+// Errors sheet of the errors as stream produces them.
+func writeXlsx(w io.Writer, stream func(emit func(handler.CSVLine) error) error) error {
+	book := excelize.NewFile()
+	defer book.Close()
+	if err := book.SetSheetName("Sheet1", "Results"); err != nil {
+		return err
+	}
+	if _, err := book.NewSheet("Errors"); err != nil {
+		return err
+	}
+	results, err := book.NewStreamWriter("Results")
+	if err != nil {
+		return err
+	}
+	if err := results.SetRow("A1", []any{"line", ColumnTotalIncome, "tax", "taxRefund"}); err != nil {
+		return err
+	}
+	var errs []handler.CSVError
+	row := 1
+	err = stream(func(line handler.CSVLine) error {
+		if line.Error != nil {
+			errs = append(errs, *line.Error)
+			return nil
+		}
+		row++
+		cell, err := excelize.CoordinatesToCellName(1, row)
+		if err != nil {
+			return err
+		}
+		tax := line.Tax
+		return results.SetRow(cell, []any{tax.Line, tax.TotalIncome.Float64(), tax.Tax.Float64(), tax.TaxRefund.Float64()})
+	})
+	if err != nil {
+		return err
+	}
+	if err := results.Flush(); err != nil {
+		return err
+	}
+
+	sheet, err := book.NewStreamWriter("Errors")
+	if err != nil {
+		return err
+	}
+	if err := sheet.SetRow("A1", []any{"line", "column", "reason"}); err != nil {
+		return err
+	}
+	for i, e := range errs {
+		cell, err := excelize.CoordinatesToCellName(1, i+2)
+		if err != nil {
+			return err
+		}
+		if err := sheet.SetRow(cell, []any{e.Line, e.Column, e.Reason}); err != nil {
+			return err
+		}
+	}
+	if err := sheet.Flush(); err != nil {
+		return err
+	}
+	return book.Write(w)
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Bgarnn/assessment-tax/database"
+	handler "github.com/Bgarnn/assessment-tax/struct"
+	"github.com/labstack/echo"
+	"github.com/xuri/excelize/v2"
+)
+
+func workbook(rows [][]any) []byte {
+	book := excelize.NewFile()
+	defer book.Close()
+	for i, row := range rows {
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		book.SetSheetRow("Sheet1", cell, &row)
+	}
+	buf := &bytes.Buffer{}
+	book.Write(buf)
+	return buf.Bytes()
+}
+
+func TestXlsxRows(t *testing.T) {
+	t.Run("should read raw values, skip blank rows and pad to the header", func(t *testing.T) {
+		book := excelize.NewFile()
+		book.SetSheetRow("Sheet1", "A1", &[]any{"totalIncome", "wht", "donation"})
+		book.SetSheetRow("Sheet1", "A2", &[]any{500000, 0})
+		book.SetSheetRow("Sheet1", "A4", &[]any{600000.5, "1,000", "1,234,567.50"})
+		style, _ := book.NewStyle(&excelize.Style{NumFmt: 3})
+		book.SetCellStyle("Sheet1", "A2", "A4", style)
+
+		reader, err := XlsxRows(book)
+		var got [][]string
+		var lines []int
+		for err == nil {
+			var record []string
+			var line int
+			if record, line, err = reader.Read(); err == nil {
+				got, lines = append(got, record), append(lines, line)
+			}
+		}
+
+		want := [][]string{{"totalIncome", "wht", "donation"}, {"500000", "0", ""}, {"600000.5", "1000", "1234567.50"}}
+		if err != io.EOF {
+			t.Errorf("expected io.EOF but got %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+		if want := []int{1, 2, 4}; !reflect.DeepEqual(lines, want) {
+			t.Errorf("expected sheet rows %v but got %v", want, lines)
+		}
+	})
+}
+
+func TestCsvXlsx(t *testing.T) {
+	data := database.DataStruct{
+		PersonalAllowance: handler.Baht(60000),
+		Allowances:        database.DefaultAllowanceRules(),
+		Groups:            database.DefaultAllowanceGroups(),
+		Brackets:          database.DefaultBrackets(),
+	}
+	upload := func(name string, file []byte, query string, limits CsvLimits) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		part, _ := form.CreateFormFile("taxFile", name)
+		part.Write(file)
+		form.Close()
+		req := httptest.NewRequest(http.MethodPost, "/?"+query, body)
+		req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+		res := httptest.NewRecorder()
+		Csv(echo.New().NewContext(req, res), loadData(data), limits)
+		return res
+	}
+	file := workbook([][]any{{"totalIncome", "wht", "donation"}, {500000, 0, 0}, {500000, 600000, 0}})
+	t.Run("should map xlsx columns like csv columns", func(t *testing.T) {
+		res := upload("taxes.xlsx", file, "mode="+ModeBestEffort, DefaultCsvLimits())
+
+		if res.Result().StatusCode != http.StatusOK {
+			t.Errorf("expected status %v but got status %v", http.StatusOK, res.Result().StatusCode)
+		}
+		var got handler.ResponseCSVReport
+		json.Unmarshal(res.Body.Bytes(), &got)
+		want := handler.ResponseCSVReport{
+			Taxes:  []handler.ResponseCSV{{Line: 2, TotalIncome: handler.Baht(500000), Tax: handler.Baht(29000)}},
+			Errors: []handler.CSVError{{Line: 3, Column: ColumnWht, Reason: "wht must be between 0 and totalIncome"}},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	})
+	t.Run("should report the row number of the sheet past blank rows", func(t *testing.T) {
+		file := workbook([][]any{{"totalIncome", "wht"}, {500000, 0}, {}, {500000, 600000}})
+
+		res := upload("taxes.xlsx", file, "mode="+ModeBestEffort, DefaultCsvLimits())
+
+		var got handler.ResponseCSVReport
+		json.Unmarshal(res.Body.Bytes(), &got)
+		if len(got.Taxes) != 1 || len(got.Errors) != 1 || got.Errors[0].Line != 4 {
+			t.Errorf("expected an error on row 4 but got %v", got)
+		}
+	})
+	t.Run("should return the results and errors as a workbook", func(t *testing.T) {
+		res := upload("taxes.xlsx", file, "mode="+ModeBestEffort+"&format="+FormatXlsx, DefaultCsvLimits())
+
+		if res.Header().Get(echo.HeaderContentType) != MIMEXlsx {
+			t.Errorf("expected content type %v but got %v", MIMEXlsx, res.Header().Get(echo.HeaderContentType))
+		}
+		book, err := excelize.OpenReader(res.Body)
+		if err != nil {
+			t.Errorf("Cannot open workbook: %v", err)
+			return
+		}
+		results, _ := book.GetRows("Results")
+		errs, _ := book.GetRows("Errors")
+		wantResults := [][]string{{"line", "totalIncome", "tax", "taxRefund"}, {"2", "500000", "29000", "0"}}
+		wantErrs := [][]string{{"line", "column", "reason"}, {"3", "wht", "wht must be between 0 and totalIncome"}}
+		if !reflect.DeepEqual(results, wantResults) {
+			t.Errorf("expected %v but got %v", wantResults, results)
+		}
+		if !reflect.DeepEqual(errs, wantErrs) {
+			t.Errorf("expected %v but got %v", wantErrs, errs)
+		}
+	})
+	t.Run("should reject a workbook that unzips past the limit", func(t *testing.T) {
+		rows := [][]any{{"totalIncome"}}
+		for i := range 100 {
+			rows = append(rows, []any{fmt.Sprint(i, strings.Repeat("0", 30000))})
+		}
+		file := workbook(rows)
+		limits := DefaultCsvLimits()
+		limits.MaxBytes = int64(len(file))
+
+		res := upload("taxes.xlsx", file, "", limits)
+
+		if res.Result().StatusCode != http.StatusBadRequest || !strings.Contains(res.Body.String(), "unzip size") {
+			t.Errorf("expected status %v for the unzip size but got %v %v", http.StatusBadRequest, res.Result().StatusCode, res.Body.String())
+		}
+	})
+	t.Run("should reject a file that is not a workbook", func(t *testing.T) {
+		res := upload("taxes.xlsx", []byte("totalIncome\n500000\n"), "", DefaultCsvLimits())
+
+		if res.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %v but got status %v", http.StatusBadRequest, res.Result().StatusCode)
+		}
+	})
+}
@@ -1,38 +1,492 @@
 package handler
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type RequestCalculation struct {
-	TotalIncome float64         `json:"totalIncome"`
-	Wht         float64         `json:"wht"`
+	TaxYear     int             `json:"taxYear"`
+	TotalIncome Money           `json:"totalIncome"`
+	Wht         Money           `json:"wht"`
+	Incomes     []IncomeArr     `json:"incomes,omitempty"`
 	Allowances  []AllowancesArr `json:"allowances"`
+	Dependents  []Dependent     `json:"dependents,omitempty"`
+}
+
+// Relationships a Dependent can have.
+const (
+	RelationshipSpouse = "spouse"
+	RelationshipChild  = "child"
+	RelationshipParent = "parent"
+	RelationshipOther  = "other"
+)
+
+// Dependent is a family member the taxpayer supports. BirthYear is in the
+// Buddhist era like taxYear. HasIncome means the dependent earned more than
+// the limit that makes them ineligible. Disabled dependents, of any
+// relationship, also earn the disabled allowance.
+type Dependent struct {
+	Relationship string `json:"relationship"`
+	BirthYear    int    `json:"birthYear"`
+	HasIncome    bool   `json:"hasIncome"`
+	Studying     bool   `json:"studying,omitempty"`
+	Disabled     bool   `json:"disabled,omitempty"`
+}
+
+// DependentAllowance is one allowance claimed for the dependent at Index of
+// the request. An ineligible claim has a zero Amount and says why in Reason.
+type DependentAllowance struct {
+	Index     int    `json:"index"`
+	Allowance string `json:"allowance"`
+	Amount    Money  `json:"amount"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// DependentRules are the family allowances of a tax year. Every child from
+// the second on who was born in ChildBonusFromYear or later earns
+// ChildBonus instead of Child.
+type DependentRules struct {
+	Spouse             Money `json:"spouse"`
+	Child              Money `json:"child"`
+	ChildBonus         Money `json:"childBonus"`
+	ChildBonusFromYear int   `json:"childBonusFromYear"`
+	Parent             Money `json:"parent"`
+	ParentMinAge       int   `json:"parentMinAge"`
+	Disabled           Money `json:"disabled"`
+}
+
+// IncomeArr is the income from one payer, with the tax that payer withheld
+// as shown on its withholding certificate. Category is the section of the
+// Revenue Code the income falls under, from 40(1) to 40(8).
+type IncomeArr struct {
+	Payer         string `json:"payer"`
+	Category      string `json:"category"`
+	Amount        Money  `json:"amount"`
+	Wht           Money  `json:"wht"`
+	ActualExpense Money  `json:"actualExpense,omitempty"`
+}
+
+// IncomeCategories are the assessable income sections of the Revenue Code.
+var IncomeCategories = []string{"40(1)", "40(2)", "40(3)", "40(4)", "40(5)", "40(6)", "40(7)", "40(8)"}
+
+// ExpenseRule is the expense deduction of one income category: Rate of the
+// income, capped at Amount (0 means no cap). Categories in the same Group
+// are added together before the rate and cap apply. When Actual is set the
+// taxpayer may claim actual expenses instead of the flat rate.
+type ExpenseRule struct {
+	Category string  `json:"category"`
+	Rate     float64 `json:"rate"`
+	Amount   Money   `json:"amount"`
+	Group    string  `json:"group,omitempty"`
+	Actual   bool    `json:"actual"`
 }
 
+type RequestExpenses struct {
+	Expenses []ExpenseRule `json:"expenses"`
+}
+
+// AllowancesArr is one claimed allowance. Subtype picks a variant of the
+// type, such as the kind of a donation; empty is the general variant.
 type AllowancesArr struct {
-	AllowanceType string  `json:"allowanceType"`
-	Amount        float64 `json:"amount"`
+	AllowanceType string `json:"allowanceType"`
+	Subtype       string `json:"subtype,omitempty"`
+	Amount        Money  `json:"amount"`
 }
 
 type ResponseCalculation struct {
-	TaxRefund float64       `json:"taxRefund,omitempty"`
-	Tax       float64       `json:"tax"`
-	TaxLevel  []TaxLevelArr `json:"taxLevel"`
+	TaxRefund         Money                `json:"taxRefund,omitempty"`
+	Tax               Money                `json:"tax"`
+	TaxMethod         string               `json:"taxMethod"`
+	ProgressiveTax    Money                `json:"progressiveTax"`
+	GrossIncomeTax    Money                `json:"grossIncomeTax"`
+	DonationDeduction Money                `json:"donationDeduction"`
+	ExpenseDeduction  Money                `json:"expenseDeduction"`
+	TaxableIncome     Money                `json:"taxableIncome"`
+	EffectiveRate     float64              `json:"effectiveRate"`
+	MarginalRate      float64              `json:"marginalRate"`
+	CurrentBracket    string               `json:"currentBracket"`
+	Dependents        []DependentAllowance `json:"dependentAllowances,omitempty"`
+	Allowances        []AllowanceDeduction `json:"allowances,omitempty"`
+	TaxLevel          []TaxLevelArr        `json:"taxLevel"`
+	Trace             []TraceStep          `json:"trace,omitempty"`
 }
 
 type TaxLevelArr struct {
-	Level string  `json:"level"`
-	Tax   float64 `json:"tax"`
+	Level string `json:"level"`
+	Tax   Money  `json:"tax"`
 }
 
 type RequestDeduction struct {
-	Amount float64 `json:"amount"`
+	TaxYear int   `json:"taxYear"`
+	Amount  Money `json:"amount"`
 }
 
 type RequestCsv struct {
-	TotalIncome float64 `json:"totalIncome"`
-	Tax         float64 `json:"tax"`
+	TotalIncome Money `json:"totalIncome"`
+	Tax         Money `json:"tax"`
 }
 
 type ResponseCSV struct {
-	TotalIncome float64 `json:"totalIncome"`
-	Tax         float64 `json:"tax"`
-	TaxRefund   float64 `json:"taxRefund,omitempty"`
+	Line        int   `json:"line"`
+	TotalIncome Money `json:"totalIncome"`
+	Tax         Money `json:"tax"`
+	TaxRefund   Money `json:"taxRefund,omitempty"`
+}
+
+// CSVError is a problem with one cell, or with a whole row when Column is
+// empty. Line counts the header as line 1.
+type CSVError struct {
+	Line   int    `json:"line"`
+	Column string `json:"column,omitempty"`
+	Reason string `json:"reason"`
+}
+
+type ResponseCSVReport struct {
+	Taxes  []ResponseCSV `json:"taxes"`
+	Errors []CSVError    `json:"errors,omitempty"`
+}
+
+type Bracket struct {
+	MinAmount Money   `json:"minAmount"`
+	MaxAmount *Money  `json:"maxAmount"`
+	Rate      float64 `json:"rate"`
+}
+
+type RequestBrackets struct {
+	Brackets []Bracket `json:"brackets"`
+}
+
+type TaxYearRules struct {
+	TaxYear           int              `json:"taxYear"`
+	PersonalDeduction Money            `json:"personalDeduction"`
+	Allowances        []AllowanceRule  `json:"allowances"`
+	Groups            []AllowanceGroup `json:"groups"`
+	Expenses          []ExpenseRule    `json:"expenses"`
+	MinimumTax        *MinimumTax      `json:"minimumTax"`
+	Dependents        *DependentRules  `json:"dependents"`
+	Brackets          []Bracket        `json:"brackets"`
+}
+
+// MinimumTax is the alternative tax on gross income other than salary:
+// when the 40(2) to 40(8) income reaches Threshold, the tax is at least
+// Rate of that income. A Rate of 0 turns it off.
+type MinimumTax struct {
+	Rate      float64 `json:"rate"`
+	Threshold Money   `json:"threshold"`
+}
+
+// Tax methods a calculation reports as taxMethod.
+const (
+	TaxMethodProgressive = "progressive"
+	TaxMethodGrossIncome = "grossIncome"
+)
+
+// Cap types an AllowanceRule can declare.
+const (
+	CapFixed            = "fixed"
+	CapIncomePercent    = "incomePercent"
+	CapNetIncomePercent = "netIncomePercent"
+	CapGroup            = "group"
+)
+
+// AllowanceRule caps one allowanceType and Subtype. Amount is the cap for
+// CapFixed and an optional ceiling (0 means none) for the other cap types.
+// The Rate of a percentage cap applies to total income or to net income
+// after every other deduction. A claim counts Multiplier times (0 means
+// once) before it is capped. A rule in a Group is also limited by that
+// group's cap, shared with the other rules in the group.
+type AllowanceRule struct {
+	AllowanceType string  `json:"allowanceType"`
+	Subtype       string  `json:"subtype,omitempty"`
+	CapType       string  `json:"capType"`
+	Amount        Money   `json:"amount"`
+	Rate          float64 `json:"rate"`
+	Multiplier    float64 `json:"multiplier,omitempty"`
+	Group         string  `json:"group,omitempty"`
+}
+
+// Key identifies a rule within a tax year, e.g. "donation/education".
+func (rule AllowanceRule) Key() string {
+	if rule.Subtype == "" {
+		return rule.AllowanceType
+	}
+	return rule.AllowanceType + "/" + rule.Subtype
+}
+
+// Key returns the Key of the rule the claim falls under.
+func (a AllowancesArr) Key() string {
+	return AllowanceRule{AllowanceType: a.AllowanceType, Subtype: a.Subtype}.Key()
+}
+
+func (rule AllowanceRule) MultiplierOrOne() float64 {
+	if rule.Multiplier == 0 {
+		return 1
+	}
+	return rule.Multiplier
+}
+
+// AllowanceDeduction reports how much of a requested allowance was
+// deducted. LostToGroup is the part its own cap allowed but the shared cap
+// of its group did not.
+type AllowanceDeduction struct {
+	AllowanceType string `json:"allowanceType"`
+	Subtype       string `json:"subtype,omitempty"`
+	Requested     Money  `json:"requested"`
+	Deductible    Money  `json:"deductible"`
+	LostToGroup   Money  `json:"lostToGroup"`
+	CappedBy      string `json:"cappedBy,omitempty"`
+}
+
+// AllowanceGroup is a cap shared by its rules. A group with a Rate caps
+// them at Rate of the net income after every other deduction, and at
+// Amount too when it is not 0; its rules are evaluated last.
+type AllowanceGroup struct {
+	Name   string  `json:"name"`
+	Amount Money   `json:"amount"`
+	Rate   float64 `json:"rate,omitempty"`
+}
+
+type RequestAllowances struct {
+	Allowances []AllowanceRule  `json:"allowances"`
+	Groups     []AllowanceGroup `json:"groups"`
+}
+
+type ValidationErr struct {
+	Index  int    `json:"index"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+type ResponseValidation struct {
+	Message string          `json:"message"`
+	Errors  []ValidationErr `json:"errors"`
+}
+
+// TraceStep is one intermediate result of a calculation in explain mode.
+type TraceStep struct {
+	Step      string   `json:"step"`
+	Name      string   `json:"name,omitempty"`
+	Requested *Money   `json:"requested,omitempty"`
+	Amount    Money    `json:"amount"`
+	Rate      *float64 `json:"rate,omitempty"`
+	Tax       *Money   `json:"tax,omitempty"`
+	Note      string   `json:"note,omitempty"`
+}
+
+type RequestOptimize struct {
+	RequestCalculation
+	Budget Money `json:"budget"`
+}
+
+// OptimizeOption is how much more can be put into one allowance before its
+// caps stop it from lowering the tax. TaxSaved is the saving of using the
+// whole Room on its own.
+type OptimizeOption struct {
+	AllowanceType   string  `json:"allowanceType"`
+	Subtype         string  `json:"subtype,omitempty"`
+	Room            Money   `json:"room"`
+	TaxSavedPerBaht float64 `json:"taxSavedPerBaht"`
+	TaxSaved        Money   `json:"taxSaved"`
+}
+
+type ResponseOptimize struct {
+	Tax          Money            `json:"tax"`
+	MarginalRate float64          `json:"marginalRate"`
+	Options      []OptimizeOption `json:"options"`
+	Plan         []AllowancesArr  `json:"plan"`
+	PlanTax      Money            `json:"planTax"`
+	PlanTaxSaved Money            `json:"planTaxSaved"`
+}
+
+// Targets of a reverse calculation.
+const (
+	TargetTax       = "tax"
+	TargetNetIncome = "netIncome"
+	TargetRefund    = "refund"
+)
+
+// Bounds of a reverse calculation. BoundLowest asks for the lowest income
+// that reaches the target, BoundHighest for the highest income that does
+// not go past it, such as the most one can earn without paying tax.
+const (
+	BoundLowest  = "lowest"
+	BoundHighest = "highest"
+)
+
+// RequestReverse asks for the totalIncome at which Target reaches Amount,
+// with the other fields of the calculation as given.
+type RequestReverse struct {
+	RequestCalculation
+	Target string `json:"target"`
+	Amount Money  `json:"amount"`
+	Bound  string `json:"bound"`
+}
+
+type ResponseReverse struct {
+	TotalIncome Money               `json:"totalIncome"`
+	NetIncome   Money               `json:"netIncome"`
+	Calculation ResponseCalculation `json:"calculation"`
+}
+
+type CurvePoint struct {
+	TotalIncome   Money   `json:"totalIncome"`
+	Tax           Money   `json:"tax"`
+	EffectiveRate float64 `json:"effectiveRate"`
+	MarginalRate  float64 `json:"marginalRate"`
+}
+
+type ResponseCurve struct {
+	TaxYear int          `json:"taxYear"`
+	Points  []CurvePoint `json:"points"`
+}
+
+// Scenario is a named variant of a base request. Overrides holds the
+// fields of RequestCalculation that differ from the base; a listed field
+// replaces the base value as a whole, so overriding allowances replaces
+// every base allowance.
+type Scenario struct {
+	Name      string          `json:"name"`
+	Overrides json.RawMessage `json:"overrides"`
+}
+
+type RequestCompare struct {
+	Base      RequestCalculation `json:"base"`
+	Scenarios []Scenario         `json:"scenarios"`
+}
+
+// CalculationDiff is a scenario's result less the base result.
+type CalculationDiff struct {
+	TaxRefund         Money   `json:"taxRefund"`
+	Tax               Money   `json:"tax"`
+	ProgressiveTax    Money   `json:"progressiveTax"`
+	GrossIncomeTax    Money   `json:"grossIncomeTax"`
+	DonationDeduction Money   `json:"donationDeduction"`
+	ExpenseDeduction  Money   `json:"expenseDeduction"`
+	TaxableIncome     Money   `json:"taxableIncome"`
+	EffectiveRate     float64 `json:"effectiveRate"`
+	MarginalRate      float64 `json:"marginalRate"`
+}
+
+type ScenarioResult struct {
+	Name        string              `json:"name"`
+	Calculation ResponseCalculation `json:"calculation"`
+	Diff        CalculationDiff     `json:"diff"`
+}
+
+type ResponseCompare struct {
+	Base      ResponseCalculation `json:"base"`
+	Scenarios []ScenarioResult    `json:"scenarios"`
+}
+
+type ResponseScenarioError struct {
+	Message  string `json:"message"`
+	Scenario string `json:"scenario"`
+	Details  any    `json:"details"`
+}
+
+// SalaryChange sets the monthly salary from Month (1 to 12) onwards.
+type SalaryChange struct {
+	Month  int   `json:"month"`
+	Salary Money `json:"salary"`
+}
+
+type Bonus struct {
+	Month  int   `json:"month"`
+	Amount Money `json:"amount"`
+}
+
+type RequestWithholding struct {
+	TaxYear    int             `json:"taxYear"`
+	Salary     Money           `json:"salary"`
+	Raises     []SalaryChange  `json:"raises,omitempty"`
+	Bonuses    []Bonus         `json:"bonuses,omitempty"`
+	Allowances []AllowancesArr `json:"allowances"`
+	Dependents []Dependent     `json:"dependents,omitempty"`
+}
+
+// MonthlyWithholding is one month of a withholding schedule.
+// ProjectedIncome and ProjectedTax are the annual figures the month's
+// withholding was worked out from.
+type MonthlyWithholding struct {
+	Month           int   `json:"month"`
+	Salary          Money `json:"salary"`
+	Bonus           Money `json:"bonus"`
+	ProjectedIncome Money `json:"projectedIncome"`
+	ProjectedTax    Money `json:"projectedTax"`
+	Withholding     Money `json:"withholding"`
+}
+
+type ResponseWithholding struct {
+	AnnualIncome  Money                `json:"annualIncome"`
+	AnnualTax     Money                `json:"annualTax"`
+	TotalWithheld Money                `json:"totalWithheld"`
+	Months        []MonthlyWithholding `json:"months"`
+}
+
+// RequestBonus asks for the tax a bonus adds to a calculation. With
+// incomes the bonus is added as an income of Category, 40(1) unless set;
+// otherwise it is added to totalIncome.
+type RequestBonus struct {
+	RequestCalculation
+	Bonus    Money  `json:"bonus"`
+	Category string `json:"category,omitempty"`
+}
+
+type ResponseBonus struct {
+	Bonus          Money               `json:"bonus"`
+	IncrementalTax Money               `json:"incrementalTax"`
+	NetBonus       Money               `json:"netBonus"`
+	EffectiveRate  float64             `json:"effectiveRate"`
+	TaxLevel       []TaxLevelArr       `json:"taxLevel"`
+	Without        ResponseCalculation `json:"without"`
+	With           ResponseCalculation `json:"with"`
+}
+
+// CSVLine is one result of a streamed CSV upload: the tax of a valid row
+// or an error of an invalid one.
+type CSVLine struct {
+	Tax   *ResponseCSV `json:"tax,omitempty"`
+	Error *CSVError    `json:"error,omitempty"`
+}
+
+// Statuses of a batch job.
+const (
+	BatchQueued  = "queued"
+	BatchRunning = "running"
+	BatchDone    = "done"
+	BatchFailed  = "failed"
+)
+
+// Batch is an asynchronous CSV calculation. ProcessedRows counts the data
+// rows whose results are stored and ErrorRows those among them that
+// failed validation.
+type Batch struct {
+	ID            int64     `json:"id"`
+	Status        string    `json:"status"`
+	Mode          string    `json:"mode"`
+	TotalRows     int       `json:"totalRows"`
+	ProcessedRows int       `json:"processedRows"`
+	ErrorRows     int       `json:"errorRows"`
+	Error         string    `json:"error,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+	// Claim counts the times the batch was claimed. A worker only updates
+	// the batch while it is still running under the claim it took.
+	Claim int64 `json:"-"`
+}
+
+// ResponseBatchResults is one page of a batch's results. Next is the
+// cursor of the following page, or 0 on the last page.
+type ResponseBatchResults struct {
+	Results []CSVLine `json:"results"`
+	Next    int64     `json:"next,omitempty"`
+}
+
+// Line returns the file line of the result.
+func (l CSVLine) Line() int {
+	if l.Error != nil {
+		return l.Error.Line
+	}
+	return l.Tax.Line
 }
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount in satang (1/100 baht). It is read from and
+// written to JSON as a plain number of baht, e.g. 29000.5.
+type Money int64
+
+const MaxMoney = Money(math.MaxInt64)
+
+func Baht(amount int64) Money {
+	return Money(amount * 100)
+}
+
+// ParseMoney reads a decimal baht amount. Digits beyond the satang are
+// rounded half away from zero.
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.ContainsAny(s, "/") {
+		return 0, fmt.Errorf("invalid amount: %q", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("invalid amount: %q", s)
+	}
+	r.Mul(r, big.NewRat(100, 1))
+	num, den := r.Num(), r.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() != 0 && new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(den) >= 0 {
+		q.Add(q, big.NewInt(int64(num.Sign())))
+	}
+	if !q.IsInt64() {
+		return 0, fmt.Errorf("amount out of range: %q", s)
+	}
+	return Money(q.Int64()), nil
+}
+
+func (m Money) Float64() float64 {
+	return float64(m) / 100
+}
+
+// String renders the amount in baht without trailing zeros, e.g. "29000",
+// "29000.5" or "29000.05".
+func (m Money) String() string {
+	sign := ""
+	v := uint64(m)
+	if m < 0 {
+		sign, v = "-", uint64(-(m+1))+1
+	}
+	s := sign + strconv.FormatUint(v/100, 10)
+	if frac := v % 100; frac != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%02d", frac), "0")
+	}
+	return s
+}
+
+// MulRate applies a tax rate such as 0.10. Fractions of a satang are
+// dropped, following the Revenue Department rule for tax payable.
+func (m Money) MulRate(rate float64) Money {
+	// Rates are configured as short decimals, so read back the shortest
+	// decimal form instead of the binary float value.
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(rate, 'f', -1, 64))
+	if !ok {
+		return 0
+	}
+	r.Mul(r, new(big.Rat).SetInt64(int64(m)))
+	return Money(new(big.Int).Quo(r.Num(), r.Denom()).Int64())
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		return fmt.Errorf("amount must be a number: %s", s)
+	}
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value stores the amount in a NUMERIC column.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+func (m *Money) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		parsed, err := ParseMoney(string(v))
+		*m = parsed
+		return err
+	case string:
+		parsed, err := ParseMoney(v)
+		*m = parsed
+		return err
+	case float64:
+		parsed, err := ParseMoney(strconv.FormatFloat(v, 'f', -1, 64))
+		*m = parsed
+		return err
+	case int64:
+		*m = Baht(v)
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into Money", src)
+}
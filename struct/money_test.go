@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	t.Run("should read satang exactly", func(t *testing.T) {
+		got, err := ParseMoney("150000.10")
+
+		if err != nil || got != Money(15000010) {
+			t.Errorf("expected %v, but got %v (%v)", Money(15000010), got, err)
+		}
+	})
+	t.Run("should round half away from zero", func(t *testing.T) {
+		got, err := ParseMoney("0.125")
+
+		if err != nil || got != Money(13) {
+			t.Errorf("expected %v, but got %v (%v)", Money(13), got, err)
+		}
+	})
+	t.Run("should reject text", func(t *testing.T) {
+		if _, err := ParseMoney("abc"); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+}
+
+func TestMoneyJSON(t *testing.T) {
+	t.Run("should marshal as number of baht", func(t *testing.T) {
+		got, _ := json.Marshal([]Money{Baht(29000), Money(2900050), Money(-5)})
+
+		if string(got) != "[29000,29000.5,-0.05]" {
+			t.Errorf("expected %v, but got %v", "[29000,29000.5,-0.05]", string(got))
+		}
+	})
+	t.Run("should unmarshal number of baht", func(t *testing.T) {
+		var got struct {
+			Amount Money `json:"amount"`
+		}
+
+		err := json.Unmarshal([]byte(`{"amount": 0.3}`), &got)
+
+		if err != nil || got.Amount != Money(30) {
+			t.Errorf("expected %v, but got %v (%v)", Money(30), got.Amount, err)
+		}
+	})
+}
+
+func TestMulRate(t *testing.T) {
+	t.Run("should apply rate without drift", func(t *testing.T) {
+		got := Money(30).MulRate(0.1)
+
+		if got != Money(3) {
+			t.Errorf("expected %v, but got %v", Money(3), got)
+		}
+	})
+	t.Run("should drop fractions of a satang", func(t *testing.T) {
+		got := Money(19).MulRate(0.35)
+
+		if got != Money(6) {
+			t.Errorf("expected %v, but got %v", Money(6), got)
+		}
+	})
+}
+
+func TestScan(t *testing.T) {
+	t.Run("should scan numeric text", func(t *testing.T) {
+		var got Money
+
+		err := got.Scan([]byte("60000.00"))
+
+		if err != nil || got != Baht(60000) {
+			t.Errorf("expected %v, but got %v (%v)", Baht(60000), got, err)
+		}
+	})
+}